@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// append-only JSONL record of API mutations, SPR firewall calls, route
+// advertisements and login attempts. the file is rotated by size, keeping
+// AuditLogBackups old files as audit.jsonl.1, .2, ...
+
+var AuditLogFile = TEST_PREFIX + "/state/plugins/spr-tailscale/audit.jsonl"
+var AuditLogMaxSize int64 = 5 * 1024 * 1024
+var AuditLogBackups = 3
+
+const (
+	AuditAPI      = "api"
+	AuditFirewall = "firewall"
+	AuditRoutes   = "routes"
+	AuditLogin    = "login"
+)
+
+type AuditEntry struct {
+	Time    time.Time
+	Kind    string
+	Action  string
+	Actor   string      `json:",omitempty"` //who asked, for API requests
+	Target  string      `json:",omitempty"` //peer IP, rule or path acted on
+	Detail  interface{} `json:",omitempty"`
+	Success bool
+	Error   string `json:",omitempty"`
+}
+
+var auditMtx sync.Mutex
+
+func rotateAuditLogLocked() {
+	info, err := os.Stat(AuditLogFile)
+	if err != nil || info.Size() < AuditLogMaxSize {
+		return
+	}
+	for i := AuditLogBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", AuditLogFile, i), fmt.Sprintf("%s.%d", AuditLogFile, i+1))
+	}
+	os.Rename(AuditLogFile, AuditLogFile+".1")
+}
+
+// audit appends an entry. failures to write are only printed, they must not
+// get in the way of the action being audited
+func audit(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("[-] Failed to encode audit entry", err)
+		return
+	}
+
+	auditMtx.Lock()
+	defer auditMtx.Unlock()
+
+	rotateAuditLogLocked()
+
+	f, err := os.OpenFile(AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Println("[-] Failed to open audit log", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		fmt.Println("[-] Failed to write audit log", err)
+	}
+}
+
+func auditResult(entry AuditEntry, err error) {
+	entry.Success = err == nil
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	audit(entry)
+}
+
+// requestActor names who made a request, as user@address when both are known.
+// requests through SPR's plugin proxy carry the client in X-Forwarded-For and
+// the user in X-SPR-User or the Authorization header, requests straight to
+// the socket have neither
+func requestActor(r *http.Request) string {
+	address := ""
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		//the first entry is the client, the rest are proxies
+		address = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	} else if real := r.Header.Get("X-Real-IP"); real != "" {
+		address = real
+	} else if r.RemoteAddr != "" && r.RemoteAddr != "@" {
+		address = r.RemoteAddr
+	}
+
+	user := r.Header.Get("X-SPR-User")
+	if name, _, ok := r.BasicAuth(); ok && user == "" {
+		user = name
+	} else if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") && user == "" {
+		user = "token"
+	}
+
+	switch {
+	case user != "" && address != "":
+		return user + "@" + address
+	case user != "":
+		return user
+	case address != "":
+		return address
+	}
+	return "local"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// what a request changed in config.json
+type requestAuditDetail struct {
+	// StableIDs, or IPs for entries without one, of the Peers entries added,
+	// changed or removed
+	Peers   []string `json:",omitempty"`
+	Changes []string `json:",omitempty"`
+}
+
+func peerAuditID(peer TailscalePeer) string {
+	if peer.StableID != "" {
+		return peer.StableID
+	}
+	return peer.IP
+}
+
+func changedPeers(old []TailscalePeer, new []TailscalePeer) []string {
+	index := func(peers []TailscalePeer) map[string]TailscalePeer {
+		byID := map[string]TailscalePeer{}
+		for _, peer := range peers {
+			byID[peerAuditID(peer)] = peer
+		}
+		return byID
+	}
+	oldByID, newByID := index(old), index(new)
+
+	ids := []string{}
+	for id, peer := range newByID {
+		if before, ok := oldByID[id]; !ok || !reflect.DeepEqual(before, peer) {
+			ids = append(ids, id)
+		}
+	}
+	for id := range oldByID {
+		if _, ok := newByID[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+type requestAuditKey struct{}
+
+// the config writes made on behalf of one request, see writeConfigLocked
+type requestAudit struct {
+	mtx    sync.Mutex
+	detail requestAuditDetail
+}
+
+// recordConfigWrite adds a write of config.json from old to new to the audit
+// entry of the request ctx belongs to, if any
+func recordConfigWrite(ctx context.Context, old []byte, new []byte) {
+	ra, ok := ctx.Value(requestAuditKey{}).(*requestAudit)
+	if !ok {
+		return
+	}
+	before, after := Config{}, Config{}
+	json.Unmarshal(old, &before)
+	json.Unmarshal(new, &after)
+
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	ra.detail.Peers = appendUnique(ra.detail.Peers, changedPeers(before.Peers, after.Peers)...)
+	slices.Sort(ra.detail.Peers)
+	ra.detail.Changes = append(ra.detail.Changes, diffConfig(old, new)...)
+}
+
+// POSTs that only compute an answer
+var readOnlyRequests = map[string]bool{
+	"/rules/test": true,
+}
+
+// auditRequests records every request that is not a read, with the config
+// changes its handler wrote
+func auditRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions ||
+			readOnlyRequests[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ra := &requestAudit{}
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		handler.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestAuditKey{}, ra)))
+
+		entry := AuditEntry{
+			Kind:    AuditAPI,
+			Action:  r.Method,
+			Actor:   requestActor(r),
+			Target:  r.URL.Path,
+			Success: rec.status < 400,
+		}
+		if !entry.Success {
+			entry.Error = http.StatusText(rec.status)
+		}
+
+		ra.mtx.Lock()
+		if len(ra.detail.Changes) > 0 {
+			entry.Detail = ra.detail
+		}
+		ra.mtx.Unlock()
+		audit(entry)
+	})
+}
+
+// entries from the rotated files and the current one, oldest first
+func readAuditLog() []AuditEntry {
+	files := []string{}
+	for i := AuditLogBackups; i >= 1; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", AuditLogFile, i))
+	}
+	files = append(files, AuditLogFile)
+
+	entries := []AuditEntry{}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := AuditEntry{}
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		f.Close()
+	}
+	return entries
+}
+
+// GET /audit?kind=firewall&target=100.&since=RFC3339&until=RFC3339&limit=100
+// returns the newest matching entries, oldest first. target matches by prefix.
+func (tsp *tailscalePlugin) handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 200
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+
+	var since, until time.Time
+	for name, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": expected RFC3339", 400)
+				return
+			}
+			*dst = t
+		}
+	}
+
+	kind := query.Get("kind")
+	target := query.Get("target")
+
+	auditMtx.Lock()
+	entries := readAuditLog()
+	auditMtx.Unlock()
+
+	matched := []AuditEntry{}
+	for _, entry := range entries {
+		if kind != "" && entry.Kind != kind {
+			continue
+		}
+		if target != "" && !strings.HasPrefix(entry.Target, target) {
+			continue
+		}
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && entry.Time.After(until) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(matched); err != nil {
+		httpInternalError("Encoding audit log failed", err, w)
+		return
+	}
+}
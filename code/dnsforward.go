@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	sprbus "github.com/spr-networks/sprbus-json"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// a small DNS forwarder on the container's spr-tailscale address so SPR
+// devices can resolve MagicDNS names, over UDP and TCP. names of tailnet
+// nodes are answered from the netmap, everything else goes to tailscale's
+// resolver at 100.100.100.100.
+//
+// registering the zone with SPR's DNS is not implemented: SPR has no API for
+// forward zones and its CoreDNS configuration is outside this container. the
+// admin adds the block from GET /dns by hand. the zone is also published on
+// sprbus for scripts, SPR does not act on it.
+
+var MagicDNSUpstream = "100.100.100.100:53"
+var DNSForwarderPort = "53"
+var DNSForwarderTTL uint32 = 60
+
+type dnsForwarder struct {
+	mtx      sync.Mutex
+	conn     net.PacketConn
+	listener net.Listener
+	addr     string
+
+	// held while a query refreshes the cached status
+	refreshMtx sync.Mutex
+}
+
+var gDNSForwarder = &dnsForwarder{}
+
+type DNSStatus struct {
+	Enabled   bool
+	Listening bool
+	// where SPR should forward Zone to
+	Address  string `json:",omitempty"`
+	Zone     string `json:",omitempty"`
+	Upstream string
+	// server block for SPR's CoreDNS configuration
+	Corefile string `json:",omitempty"`
+}
+
+type dnsRequest struct {
+	Enabled bool
+}
+
+func magicDNSSuffix(status *ipnstate.Status) string {
+	if status.CurrentTailnet != nil {
+		return strings.Trim(status.CurrentTailnet.MagicDNSSuffix, ".")
+	}
+	return ""
+}
+
+// lookupTailnetName resolves a fully qualified tailnet name from the netmap
+func lookupTailnetName(status *ipnstate.Status, name string) ([]netip.Addr, bool) {
+	nodes := []*ipnstate.PeerStatus{}
+	if status.Self != nil {
+		nodes = append(nodes, status.Self)
+	}
+	for _, peer := range status.Peer {
+		nodes = append(nodes, peer)
+	}
+
+	for _, node := range nodes {
+		if strings.EqualFold(strings.TrimSuffix(node.DNSName, "."), name) {
+			return node.TailscaleIPs, true
+		}
+	}
+	return nil, false
+}
+
+// answerFromNetmap builds a reply for a query about a tailnet node, or
+// returns false when the query has to be forwarded
+func answerFromNetmap(status *ipnstate.Status, query []byte) ([]byte, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return nil, false
+	}
+	question := questions[0]
+
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	suffix := magicDNSSuffix(status)
+	if suffix == "" || !strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(suffix)) {
+		return nil, false
+	}
+	addrs, found := lookupTailnetName(status, name)
+	if !found {
+		return nil, false
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	builder.EnableCompression()
+	if builder.StartQuestions() != nil || builder.Question(question) != nil || builder.StartAnswers() != nil {
+		return nil, false
+	}
+
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: DNSForwarderTTL}
+	for _, addr := range addrs {
+		if addr.Is4() && question.Type == dnsmessage.TypeA {
+			err = builder.AResource(resource, dnsmessage.AResource{A: addr.As4()})
+		} else if addr.Is6() && question.Type == dnsmessage.TypeAAAA {
+			err = builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	reply, err := builder.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
+
+// servfailReply answers query with SERVFAIL, so clients fail fast instead of
+// waiting out their timeout. false when the query cannot be parsed
+func servfailReply(query []byte) ([]byte, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeServerFailure,
+	})
+	if builder.StartQuestions() != nil {
+		return nil, false
+	}
+	for _, question := range questions {
+		if builder.Question(question) != nil {
+			return nil, false
+		}
+	}
+	reply, err := builder.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
+
+// DNS over TCP prefixes every message with its length
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func writeTCPMessage(conn net.Conn, message []byte) error {
+	if len(message) > 65535 {
+		return fmt.Errorf("DNS message too long")
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(message)))
+	_, err := conn.Write(append(framed, message...))
+	return err
+}
+
+// forwardDNS sends query upstream over network, "udp" or "tcp", so truncated
+// replies can be retried over TCP by the client like with any resolver
+func forwardDNS(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, MagicDNSUpstream, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 65535)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply[:n], nil
+}
+
+// resolverStatus returns the cached status for answering queries. queries
+// must not wait behind API handlers holding clientMtx, so a stale cache is
+// refreshed through a LocalClient of its own, by one query at a time while
+// the others answer from the stale status
+func (tsp *tailscalePlugin) resolverStatus() (*ipnstate.Status, error) {
+	tsp.statusMtx.Lock()
+	status := tsp.status
+	fresh := status != nil && time.Since(tsp.statusAt) < StatusCacheMaxAge
+	tsp.statusMtx.Unlock()
+
+	if fresh {
+		return status, nil
+	}
+	if !gDNSForwarder.refreshMtx.TryLock() {
+		if status == nil {
+			return nil, fmt.Errorf("tailscale status not available yet")
+		}
+		return status, nil
+	}
+	defer gDNSForwarder.refreshMtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client := tailscale.LocalClient{
+		Socket:        UNIX_TAILSCALE_SOCK,
+		UseSocketOnly: true,
+	}
+	refreshed, err := client.Status(ctx)
+	if err != nil {
+		if status != nil {
+			return status, nil
+		}
+		return nil, err
+	}
+	tsp.storeStatus(refreshed)
+	return refreshed, nil
+}
+
+// resolveDNS answers query from the netmap or forwards it over network
+func (tsp *tailscalePlugin) resolveDNS(network string, query []byte) ([]byte, error) {
+	status, err := tsp.resolverStatus()
+	if err == nil {
+		if reply, ok := answerFromNetmap(status, query); ok {
+			return reply, nil
+		}
+	}
+	return forwardDNS(network, query)
+}
+
+func (tsp *tailscalePlugin) handleDNSQuery(conn net.PacketConn, client net.Addr, query []byte) {
+	reply, err := tsp.resolveDNS("udp", query)
+	if err != nil {
+		fmt.Println("[-] DNS forward failed", err)
+		var ok bool
+		if reply, ok = servfailReply(query); !ok {
+			return
+		}
+	}
+	conn.WriteTo(reply, client)
+}
+
+// handleDNSConn answers queries on a TCP connection until the client is done
+// or idles out
+func (tsp *tailscalePlugin) handleDNSConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		reply, err := tsp.resolveDNS("tcp", query)
+		if err != nil {
+			fmt.Println("[-] DNS forward failed", err)
+			var ok bool
+			if reply, ok = servfailReply(query); !ok {
+				return
+			}
+		}
+		if err := writeTCPMessage(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (tsp *tailscalePlugin) serveDNSTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Println("[-] DNS forwarder stopped", err)
+			}
+			return
+		}
+		go tsp.handleDNSConn(conn)
+	}
+}
+
+func (tsp *tailscalePlugin) serveDNS(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Println("[-] DNS forwarder stopped", err)
+			}
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go tsp.handleDNSQuery(conn, client, query)
+	}
+}
+
+// startDNSForwarder listens on the container's address over UDP and TCP, it
+// is a no-op when the forwarder already runs
+func (tsp *tailscalePlugin) startDNSForwarder() error {
+	gDNSForwarder.mtx.Lock()
+	defer gDNSForwarder.mtx.Unlock()
+
+	if gDNSForwarder.conn != nil {
+		return nil
+	}
+
+	ip := containerIPv4()
+	if ip == "" {
+		return fmt.Errorf("no container address to listen on")
+	}
+	addr := net.JoinHostPort(ip, DNSForwarderPort)
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	gDNSForwarder.conn = conn
+	gDNSForwarder.listener = listener
+	gDNSForwarder.addr = addr
+	go tsp.serveDNS(conn)
+	go tsp.serveDNSTCP(listener)
+
+	fmt.Println("[+] DNS forwarder listening on", addr)
+	return nil
+}
+
+func stopDNSForwarder() {
+	gDNSForwarder.mtx.Lock()
+	defer gDNSForwarder.mtx.Unlock()
+
+	if gDNSForwarder.conn != nil {
+		gDNSForwarder.conn.Close()
+		gDNSForwarder.listener.Close()
+		gDNSForwarder.conn = nil
+		gDNSForwarder.listener = nil
+		gDNSForwarder.addr = ""
+	}
+}
+
+// setDNSForwarding starts or stops the forwarder to match the setting
+func (tsp *tailscalePlugin) setDNSForwarding(enabled bool) error {
+	if enabled {
+		return tsp.startDNSForwarder()
+	}
+	stopDNSForwarder()
+	return nil
+}
+
+func dnsCorefile(zone string, addr string) string {
+	return zone + " {\n    forward . " + addr + "\n}\n"
+}
+
+func (tsp *tailscalePlugin) dnsStatus(ctx context.Context) DNSStatus {
+	Configmtx.RLock()
+	result := DNSStatus{Enabled: gConfig.DNSForwarder, Upstream: MagicDNSUpstream}
+	Configmtx.RUnlock()
+
+	gDNSForwarder.mtx.Lock()
+	result.Listening = gDNSForwarder.conn != nil
+	result.Address = gDNSForwarder.addr
+	gDNSForwarder.mtx.Unlock()
+
+	tsp.clientMtx.Lock()
+	status, err := tsp.cachedStatus(ctx)
+	tsp.clientMtx.Unlock()
+	if err == nil {
+		result.Zone = magicDNSSuffix(status)
+	}
+
+	if result.Listening && result.Zone != "" {
+		result.Corefile = dnsCorefile(result.Zone, result.Address)
+	}
+	return result
+}
+
+// publishDNSZone announces the zone and forwarder address on sprbus
+func (tsp *tailscalePlugin) publishDNSZone(ctx context.Context) {
+	status := tsp.dnsStatus(ctx)
+	if status.Listening && status.Zone != "" {
+		sprbus.Publish("tailscale:dns", map[string]string{"Zone": status.Zone, "Forwarder": status.Address})
+	} else {
+		sprbus.Publish("tailscale:dns", map[string]string{})
+	}
+}
+
+func (tsp *tailscalePlugin) handleGetDNS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tsp.dnsStatus(r.Context()))
+}
+
+// PUT /dns turns the forwarder on or off
+func (tsp *tailscalePlugin) handleSetDNS(w http.ResponseWriter, r *http.Request) {
+	req := dnsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := tsp.setDNSForwarding(req.Enabled); err != nil {
+		httpInternalError("Starting DNS forwarder failed", err, w)
+		return
+	}
+
+	Configmtx.Lock()
+	gConfig.DNSForwarder = req.Enabled
+	err := writeConfigLocked(r.Context())
+	Configmtx.Unlock()
+	if err != nil {
+		httpInternalError("Saving DNS forwarder setting failed", err, w)
+		return
+	}
+
+	tsp.publishDNSZone(r.Context())
+	tsp.handleGetDNS(w, r)
+}
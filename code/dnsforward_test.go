@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func testDNSQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func testDNSStatus() *ipnstate.Status {
+	return &ipnstate.Status{
+		CurrentTailnet: &ipnstate.TailnetStatus{MagicDNSSuffix: "tailnet-xyz.ts.net"},
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "spr.tailnet-xyz.ts.net.",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.10")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "nas.tailnet-xyz.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+			},
+		},
+	}
+}
+
+// the header and answer addresses of a reply
+func parseDNSReply(t *testing.T, reply []byte) (dnsmessage.Header, []string) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []string{}
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA).String())
+		}
+	}
+	return header, addrs
+}
+
+func TestAnswerFromNetmap(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		qtype dnsmessage.Type
+		// nil when the query has to be forwarded
+		want []string
+	}{
+		{
+			name:  "A record of a peer",
+			query: "nas.tailnet-xyz.ts.net.",
+			qtype: dnsmessage.TypeA,
+			want:  []string{"100.64.0.1"},
+		},
+		{
+			name:  "AAAA record of a peer",
+			query: "nas.tailnet-xyz.ts.net.",
+			qtype: dnsmessage.TypeAAAA,
+			want:  []string{"fd7a:115c:a1e0::1"},
+		},
+		{
+			name:  "names are matched case-insensitively",
+			query: "NAS.Tailnet-XYZ.ts.net.",
+			qtype: dnsmessage.TypeA,
+			want:  []string{"100.64.0.1"},
+		},
+		{
+			name:  "this node",
+			query: "spr.tailnet-xyz.ts.net.",
+			qtype: dnsmessage.TypeA,
+			want:  []string{"100.64.0.10"},
+		},
+		{
+			name:  "other record types of a node get an empty answer",
+			query: "nas.tailnet-xyz.ts.net.",
+			qtype: dnsmessage.TypeMX,
+			want:  []string{},
+		},
+		{
+			name:  "unknown node in the zone is forwarded",
+			query: "printer.tailnet-xyz.ts.net.",
+			qtype: dnsmessage.TypeA,
+		},
+		{
+			name:  "names outside the zone are forwarded",
+			query: "example.com.",
+			qtype: dnsmessage.TypeA,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, ok := answerFromNetmap(testDNSStatus(), testDNSQuery(t, tt.query, tt.qtype))
+			if tt.want == nil {
+				if ok {
+					t.Fatal("answered a query that should be forwarded")
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("query was not answered")
+			}
+			header, addrs := parseDNSReply(t, reply)
+			if header.ID != 42 || !header.Response || !header.Authoritative || header.RCode != dnsmessage.RCodeSuccess {
+				t.Errorf("header = %+v", header)
+			}
+			if !slices.Equal(addrs, tt.want) {
+				t.Errorf("answers = %v, want %v", addrs, tt.want)
+			}
+		})
+	}
+
+	if _, ok := answerFromNetmap(&ipnstate.Status{}, testDNSQuery(t, "nas.tailnet-xyz.ts.net.", dnsmessage.TypeA)); ok {
+		t.Error("answered without a MagicDNS suffix")
+	}
+	if _, ok := answerFromNetmap(testDNSStatus(), []byte{1, 2, 3}); ok {
+		t.Error("answered a malformed query")
+	}
+}
+
+func TestServfailReply(t *testing.T) {
+	reply, ok := servfailReply(testDNSQuery(t, "example.com.", dnsmessage.TypeA))
+	if !ok {
+		t.Fatal("no reply")
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ID != 42 || !header.Response || header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("header = %+v", header)
+	}
+	question, err := parser.Question()
+	if err != nil || question.Name.String() != "example.com." {
+		t.Errorf("question = %v, %v", question, err)
+	}
+
+	if _, ok := servfailReply([]byte{1, 2, 3}); ok {
+		t.Error("replied to a malformed query")
+	}
+}
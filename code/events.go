@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GET /events streams state changes as Server-Sent Events so the UI does not
+// have to poll /status and /peers. events come from the plugin's own state:
+// the IPN bus watcher, the reconciler, the login handler and the health
+// monitor.
+
+const (
+	EventState     = "state"
+	EventPeer      = "peer"
+	EventReconcile = "reconcile"
+	EventLogin     = "login"
+	EventHealth    = "health"
+)
+
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+// a subscriber that falls this far behind misses events rather than
+// blocking the publisher
+const eventBuffer = 32
+
+var eventKeepalive = 30 * time.Second
+
+type eventHub struct {
+	mtx         sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+var gEvents = &eventHub{subscribers: map[chan Event]struct{}{}}
+
+func (hub *eventHub) subscribe() chan Event {
+	ch := make(chan Event, eventBuffer)
+	hub.mtx.Lock()
+	hub.subscribers[ch] = struct{}{}
+	hub.mtx.Unlock()
+	return ch
+}
+
+func (hub *eventHub) unsubscribe(ch chan Event) {
+	hub.mtx.Lock()
+	delete(hub.subscribers, ch)
+	hub.mtx.Unlock()
+}
+
+func (hub *eventHub) publish(event Event) {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func publishEvent(eventType string, data interface{}) {
+	gEvents.publish(Event{Type: eventType, Data: data})
+}
+
+type PeerEvent struct {
+	StableID string
+	HostName string
+	IP       string
+	Online   bool
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+func (tsp *tailscalePlugin) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+
+	ch := gEvents.subscribe()
+	defer gEvents.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	//start with what we already know so clients need no extra requests
+	tsp.statusMtx.Lock()
+	status := tsp.status
+	tsp.statusMtx.Unlock()
+	if status != nil {
+		writeEvent(w, Event{Type: EventState, Data: map[string]string{"State": status.BackendState}})
+	}
+	if last := gReconciler.status().LastRun; last != nil {
+		writeEvent(w, Event{Type: EventReconcile, Data: last})
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-ch:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
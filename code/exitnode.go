@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+// SPR devices in the exit node group have their internet traffic sent
+// through a tailnet exit node. tailscaled puts the exit node's default route
+// in its own table 52 and looks it up for all traffic at rule 5270, so we add
+// rules just ahead of it:
+//
+//	5262: from <device> iif eth0 lookup 52            exit group devices
+//	5263: lookup 52 suppress_prefixlength 0           tailnet routes for the rest
+//	5264: lookup main                                 everything else as before
+//
+// the container itself, tailnet peers and the SPR API keep using eth0.
+//
+// SPR must send the group's traffic to this container for it to be routed,
+// which the plugin cannot configure through the SPR API. sprExitSetup lists
+// the commands to run on the SPR host for that.
+
+const DefaultExitNodeGroup = "tailnet-exit"
+
+const (
+	exitRulePrefDevice  = "5262"
+	exitRulePrefTailnet = "5263"
+	exitRulePrefMain    = "5264"
+	tailscaleRouteTable = "52"
+
+	// table and rule preference used on the SPR host, see sprExitSetup
+	sprExitRouteTable = "5262"
+)
+
+type ExitNodeConfig struct {
+	StableID string `json:",omitempty"`
+	// derived, what `tailscale up --exit-node` is given by up.sh
+	IP       string `json:",omitempty" validate:"tailnetip"`
+	HostName string `json:",omitempty"`
+	// SPR group whose devices use the exit node, DefaultExitNodeGroup if empty
+	Group string `json:",omitempty" validate:"regexp=^[[:graph:]]*$"`
+}
+
+func (e ExitNodeConfig) group() string {
+	if e.Group == "" {
+		return DefaultExitNodeGroup
+	}
+	return e.Group
+}
+
+// device addresses of the exit node group, sorted
+func computeExitSources(group string, devices map[string]DeviceEntry) []string {
+	sources := []string{}
+	for _, device := range devices {
+		if device.RecentIP == "" || !slices.Contains(device.Groups, group) {
+			continue
+		}
+		if !slices.Contains(sources, device.RecentIP) {
+			sources = append(sources, device.RecentIP)
+		}
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+// what the ip rules currently route, kept in memory. known is false until the
+// first pass, which flushes whatever a previous run of the plugin left behind
+type exitRouting struct {
+	mtx     sync.Mutex
+	known   bool
+	enabled bool
+	sources []string
+}
+
+var gExitRouting = &exitRouting{}
+
+func (er *exitRouting) get() (bool, bool, []string) {
+	er.mtx.Lock()
+	defer er.mtx.Unlock()
+	return er.known, er.enabled, slices.Clone(er.sources)
+}
+
+func ipRule(family string, args ...string) error {
+	cmdArgs := append([]string{family, "rule"}, args...)
+	out, err := exec.Command("ip", cmdArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %s", strings.Join(cmdArgs, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func ipFamily(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "-6"
+	}
+	return "-4"
+}
+
+// delete every rule at a preference, `ip rule del` removes one per call
+func flushIPRules(family string, pref string) {
+	for i := 0; i < 256; i++ {
+		if ipRule(family, "del", "pref", pref) != nil {
+			return
+		}
+	}
+}
+
+// applyExitRouting installs the rules for sources, or removes them all when
+// enabled is false
+func applyExitRouting(enabled bool, sources []string) error {
+	if os.Getenv("VIRTUAL_SPR") == "1" {
+		//we share the network namespace with SPR, leave its rules alone
+		gExitRouting.mtx.Lock()
+		gExitRouting.known = true
+		gExitRouting.mtx.Unlock()
+		if enabled {
+			return fmt.Errorf("exit node routing for VIRTUAL_SPR not implemented yet")
+		}
+		return nil
+	}
+
+	gExitRouting.mtx.Lock()
+	defer gExitRouting.mtx.Unlock()
+
+	if !gExitRouting.known || !enabled {
+		for _, family := range []string{"-4", "-6"} {
+			for _, pref := range []string{exitRulePrefDevice, exitRulePrefTailnet, exitRulePrefMain} {
+				flushIPRules(family, pref)
+			}
+		}
+		gExitRouting.known = true
+		gExitRouting.enabled = false
+		gExitRouting.sources = nil
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	var errs []error
+	if !gExitRouting.enabled {
+		for _, family := range []string{"-4", "-6"} {
+			if err := ipRule(family, "add", "pref", exitRulePrefTailnet, "lookup", tailscaleRouteTable, "suppress_prefixlength", "0"); err != nil {
+				errs = append(errs, err)
+			}
+			if err := ipRule(family, "add", "pref", exitRulePrefMain, "lookup", "main"); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		gExitRouting.enabled = true
+	}
+
+	for _, source := range gExitRouting.sources {
+		if !slices.Contains(sources, source) {
+			if err := ipRule(ipFamily(source), "del", "pref", exitRulePrefDevice, "from", source, "iif", "eth0", "lookup", tailscaleRouteTable); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	installed := []string{}
+	for _, source := range sources {
+		if !slices.Contains(gExitRouting.sources, source) {
+			if err := ipRule(ipFamily(source), "add", "pref", exitRulePrefDevice, "from", source, "iif", "eth0", "lookup", tailscaleRouteTable); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		installed = append(installed, source)
+	}
+	gExitRouting.sources = installed
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to update exit node routing: %v", errs)
+	}
+	return nil
+}
+
+// sprExitSetup returns the commands that make the SPR host send the traffic
+// of sources to the container: a default route via the container in a table
+// of its own, and a rule per device address looking it up. sources without a
+// container address of their family are left out
+func sprExitSetup(containerIP string, containerIPv6 string, sources []string) []string {
+	setup := []string{}
+	via := map[string]string{"-4": containerIP, "-6": containerIPv6}
+	for _, family := range []string{"-4", "-6"} {
+		if via[family] == "" {
+			continue
+		}
+		rules := []string{}
+		for _, source := range sources {
+			if ipFamily(source) == family {
+				rules = append(rules, "ip "+family+" rule add pref "+sprExitRouteTable+" from "+source+" lookup "+sprExitRouteTable)
+			}
+		}
+		if len(rules) > 0 {
+			setup = append(setup, "ip "+family+" route replace default via "+via[family]+" table "+sprExitRouteTable)
+			setup = append(setup, rules...)
+		}
+	}
+	return setup
+}
+
+type ExitNodeStatus struct {
+	Config ExitNodeConfig
+	Group  string
+	// tailscaled has the exit node selected
+	Active bool
+	Online bool
+	// device addresses currently routed through the exit node
+	Sources []string
+	// what to run on the SPR host so it sends those devices to the container
+	SPRSetup []string
+}
+
+// the PUT /exitnode response
+type exitNodeSelection struct {
+	ExitNodeConfig
+	SPRSetup []string
+}
+
+type exitNodeRequest struct {
+	// tailscale StableNodeID or IP of the exit node
+	StableID string
+	// let tailscaled pick, see `tailscale exit-node suggest`
+	Suggest bool
+	Group   string
+}
+
+func (tsp *tailscalePlugin) handleGetExitNode(w http.ResponseWriter, r *http.Request) {
+	Configmtx.RLock()
+	cfg := gConfig.ExitNode
+	Configmtx.RUnlock()
+
+	tsp.clientMtx.Lock()
+	status, err := tsp.tsdClient.StatusWithoutPeers(r.Context())
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		httpInternalError("Getting tailscale status failed", err, w)
+		return
+	}
+
+	result := ExitNodeStatus{Config: cfg, Group: cfg.group(), Sources: []string{}}
+	if status.ExitNodeStatus != nil {
+		result.Active = true
+		result.Online = status.ExitNodeStatus.Online
+	}
+	if _, enabled, sources := gExitRouting.get(); enabled {
+		result.Sources = sources
+	}
+	result.SPRSetup = sprExitSetup(getContainerIP(), getContainerIPv6(), result.Sources)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// PUT /exitnode selects the exit node, DELETE /exitnode stops using it
+func (tsp *tailscalePlugin) handleSetExitNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		tsp.clearExitNode(w, r)
+		return
+	}
+
+	req := exitNodeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if req.StableID == "" && !req.Suggest {
+		http.Error(w, "Need an exit node StableID or Suggest", 400)
+		return
+	}
+	if os.Getenv("VIRTUAL_SPR") == "1" {
+		http.Error(w, "Exit node routing is not supported with VIRTUAL_SPR", 400)
+		return
+	}
+
+	tsp.clientMtx.Lock()
+	defer tsp.clientMtx.Unlock()
+
+	id := req.StableID
+	if req.Suggest {
+		suggestion, err := tsp.tsdClient.SuggestExitNode(r.Context())
+		if err != nil {
+			httpInternalError("Exit node suggestion failed", err, w)
+			return
+		}
+		id = string(suggestion.ID)
+	}
+
+	status, err := tsp.tsdClient.Status(r.Context())
+	if err != nil {
+		httpInternalError("Getting tailscale status failed", err, w)
+		return
+	}
+	peer := findPeerStatus(status, id)
+	if peer == nil {
+		http.Error(w, "Peer not found", 404)
+		return
+	}
+	if !peer.ExitNodeOption {
+		http.Error(w, "Peer does not offer to be an exit node", 400)
+		return
+	}
+
+	exitNode := ExitNodeConfig{StableID: string(peer.ID), HostName: peer.HostName, Group: req.Group}
+	if len(peer.TailscaleIPs) > 0 {
+		exitNode.IP = peer.TailscaleIPs[0].String()
+	}
+
+	Configmtx.Lock()
+	candidate := gConfig
+	candidate.ExitNode = exitNode
+	if err := validateConfigSections(&candidate, "ExitNode"); err != nil {
+		Configmtx.Unlock()
+		httpValidationError(err, w)
+		return
+	}
+	Configmtx.Unlock()
+
+	if err := tsp.setExitNodePrefs(r.Context(), exitNode); err != nil {
+		httpInternalError("Selecting exit node failed", err, w)
+		return
+	}
+
+	Configmtx.Lock()
+	gConfig.ExitNode = exitNode
+	err = writeConfigLocked(r.Context())
+	if err == nil {
+		err = writeTailscaleEnvLocked()
+	}
+	Configmtx.Unlock()
+	if err != nil {
+		httpInternalError("Saving exit node failed", err, w)
+		return
+	}
+
+	requestRebuild("api:exitnode")
+
+	//the rebuild has not routed the group yet, look its devices up directly
+	selection := exitNodeSelection{ExitNodeConfig: exitNode, SPRSetup: []string{}}
+	if devices, err := APIDevices(); err == nil {
+		sources := computeExitSources(exitNode.group(), devices)
+		selection.SPRSetup = sprExitSetup(getContainerIP(), getContainerIPv6(), sources)
+	} else {
+		fmt.Println("[-] Failed to load SPR devices for the exit node setup", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(selection)
+}
+
+// setExitNodePrefs points tailscaled at the exit node, or at none when it
+// has no StableID. the caller holds clientMtx
+func (tsp *tailscalePlugin) setExitNodePrefs(ctx context.Context, exitNode ExitNodeConfig) error {
+	use := exitNode.StableID != ""
+	//keep LAN access so the SPR API and devices stay reachable
+	_, err := tsp.tsdClient.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			ExitNodeID:             tailcfg.StableNodeID(exitNode.StableID),
+			ExitNodeAllowLANAccess: use,
+		},
+		ExitNodeIDSet:             true,
+		ExitNodeIPSet:             true,
+		ExitNodeAllowLANAccessSet: true,
+	})
+	if use {
+		auditResult(AuditEntry{Kind: AuditRoutes, Action: "exitnode", Target: exitNode.StableID, Detail: exitNode}, err)
+	} else {
+		auditResult(AuditEntry{Kind: AuditRoutes, Action: "exitnode-clear"}, err)
+	}
+	return err
+}
+
+func (tsp *tailscalePlugin) clearExitNode(w http.ResponseWriter, r *http.Request) {
+	tsp.clientMtx.Lock()
+	err := tsp.setExitNodePrefs(r.Context(), ExitNodeConfig{})
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		httpInternalError("Clearing exit node failed", err, w)
+		return
+	}
+
+	Configmtx.Lock()
+	gConfig.ExitNode = ExitNodeConfig{Group: gConfig.ExitNode.Group}
+	err = writeConfigLocked(r.Context())
+	if err == nil {
+		err = writeTailscaleEnvLocked()
+	}
+	Configmtx.Unlock()
+	if err != nil {
+		httpInternalError("Saving exit node failed", err, w)
+		return
+	}
+
+	requestRebuild("api:exitnode")
+}
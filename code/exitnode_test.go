@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSprExitSetup(t *testing.T) {
+	tests := []struct {
+		name          string
+		containerIPv6 string
+		sources       []string
+		want          []string
+	}{
+		{
+			name:    "no devices need no setup",
+			sources: []string{},
+			want:    []string{},
+		},
+		{
+			name:    "one rule per device",
+			sources: []string{"192.168.2.6", "192.168.2.10"},
+			want: []string{
+				"ip -4 route replace default via 192.168.2.50 table 5262",
+				"ip -4 rule add pref 5262 from 192.168.2.6 lookup 5262",
+				"ip -4 rule add pref 5262 from 192.168.2.10 lookup 5262",
+			},
+		},
+		{
+			name:    "IPv6 devices are left out without a container IPv6 address",
+			sources: []string{"192.168.2.6", "2001:db8::6"},
+			want: []string{
+				"ip -4 route replace default via 192.168.2.50 table 5262",
+				"ip -4 rule add pref 5262 from 192.168.2.6 lookup 5262",
+			},
+		},
+		{
+			name:          "IPv6 devices go via the container IPv6 address",
+			containerIPv6: "2001:db8::50",
+			sources:       []string{"2001:db8::6"},
+			want: []string{
+				"ip -6 route replace default via 2001:db8::50 table 5262",
+				"ip -6 rule add pref 5262 from 2001:db8::6 lookup 5262",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sprExitSetup(testContainerIP, tt.containerIPv6, tt.sources)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sprExitSetup() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
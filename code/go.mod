@@ -6,6 +6,7 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/spr-networks/sprbus-json v0.0.0-20260616150305-efdec19847c8
 	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/net v0.57.0
 	gopkg.in/validator.v2 v2.0.1
 	tailscale.com v1.100.0
 )
@@ -31,7 +32,6 @@ require (
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba // indirect
 	golang.org/x/crypto v0.54.0 // indirect
 	golang.org/x/exp v0.0.0-20260709172345-9ea1abe57597 // indirect
-	golang.org/x/net v0.57.0 // indirect
 	golang.org/x/sync v0.22.0 // indirect
 	golang.org/x/sys v0.47.0 // indirect
 	golang.zx2c4.com/wireguard/windows v1.0.1 // indirect
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	sprbus "github.com/spr-networks/sprbus-json"
+	"tailscale.com/client/tailscale"
+)
+
+// GET /healthz and GET /readyz check every dependency with a timeout and
+// report per component. /healthz fails only when a local dependency is gone
+// (tailscaled or sprbus), /readyz additionally needs the SPR API to be
+// reachable and to accept our token. a background loop repeats the checks
+// and publishes tailscale:health on sprbus whenever a component changes state.
+
+var HealthCheckTimeout = 2 * time.Second
+var HealthCheckInterval = 30 * time.Second
+
+const (
+	ComponentTailscaled = "tailscaled"
+	ComponentSPRAPI     = "spr_api"
+	ComponentAPIToken   = "api_token"
+	ComponentSprbus     = "sprbus"
+)
+
+// components /healthz depends on, the rest only affect /readyz
+var livenessComponents = []string{ComponentTailscaled, ComponentSprbus}
+
+type ComponentHealth struct {
+	Name    string
+	Healthy bool
+	Detail  string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	Latency string `json:",omitempty"`
+}
+
+type HealthReport struct {
+	Healthy    bool
+	Checked    time.Time
+	Components []ComponentHealth
+}
+
+// the sprbus subscription from busListener. HandleEvent blocks for as long
+// as the subscription is up, so connected is set around that call.
+type busListenerState struct {
+	mtx       sync.Mutex
+	connected bool
+	lastError string
+}
+
+var gBusState = &busListenerState{}
+
+func (bus *busListenerState) set(connected bool, err error) {
+	bus.mtx.Lock()
+	defer bus.mtx.Unlock()
+	bus.connected = connected
+	if err != nil {
+		bus.lastError = err.Error()
+	}
+}
+
+func (bus *busListenerState) get() (bool, string) {
+	bus.mtx.Lock()
+	defer bus.mtx.Unlock()
+	return bus.connected, bus.lastError
+}
+
+func checkTailscaled(ctx context.Context) ComponentHealth {
+	health := ComponentHealth{Name: ComponentTailscaled}
+
+	//a separate client so a handler holding clientMtx cannot stall the check
+	client := tailscale.LocalClient{
+		Socket:        UNIX_TAILSCALE_SOCK,
+		UseSocketOnly: true,
+	}
+
+	status, err := client.StatusWithoutPeers(ctx)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.Healthy = true
+	health.Detail = "backend " + status.BackendState
+	return health
+}
+
+// checkSPRAPI reports on both the API and the token, a single request tells
+// apart an unreachable API from one that rejects us
+func checkSPRAPI(ctx context.Context) (ComponentHealth, ComponentHealth) {
+	api := ComponentHealth{Name: ComponentSPRAPI}
+	token := ComponentHealth{Name: ComponentAPIToken}
+
+	Configmtx.RLock()
+	apiToken := gConfig.APIToken
+	Configmtx.RUnlock()
+
+	if apiToken == "" {
+		token.Error = "missing auth token"
+	}
+
+	gw, err := getGateway()
+	if err != nil {
+		api.Error = "no gateway: " + err.Error()
+		if token.Error == "" {
+			token.Error = "not verified, SPR API unreachable"
+		}
+		return api, token
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+gw+":80/firewall/config", nil)
+	if err != nil {
+		api.Error = err.Error()
+		return api, token
+	}
+	if apiToken != "" {
+		req.Header.Add("Authorization", "Bearer "+apiToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		api.Error = err.Error()
+		if token.Error == "" {
+			token.Error = "not verified, SPR API unreachable"
+		}
+		return api, token
+	}
+	resp.Body.Close()
+
+	api.Detail = gw
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		api.Healthy = true
+		if token.Error == "" {
+			token.Error = fmt.Sprintf("rejected by SPR API (%d)", resp.StatusCode)
+		}
+	case resp.StatusCode == http.StatusOK:
+		api.Healthy = true
+		token.Healthy = token.Error == ""
+	default:
+		api.Error = fmt.Sprintf("API error %d", resp.StatusCode)
+		if token.Error == "" {
+			token.Error = "not verified, SPR API failing"
+		}
+	}
+	return api, token
+}
+
+func checkSprbus(ctx context.Context) ComponentHealth {
+	health := ComponentHealth{Name: ComponentSprbus}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "unix", sprbus.ServerEventSock)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	conn.Close()
+
+	connected, lastError := gBusState.get()
+	if !connected {
+		health.Error = "device event subscription is down"
+		if lastError != "" {
+			health.Error += ": " + lastError
+		}
+		return health
+	}
+	health.Healthy = true
+	health.Detail = sprbus.ServerEventSock
+	return health
+}
+
+func timedCheck(check func(ctx context.Context) ComponentHealth) ComponentHealth {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+	defer cancel()
+
+	started := time.Now()
+	health := check(ctx)
+	health.Latency = time.Since(started).String()
+	return health
+}
+
+// checkHealth runs every check concurrently, the report is in a fixed order
+func checkHealth() HealthReport {
+	var tsd, api, token, bus ComponentHealth
+	var wg sync.WaitGroup
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		tsd = timedCheck(checkTailscaled)
+	}()
+	go func() {
+		defer wg.Done()
+		api = timedCheck(func(ctx context.Context) ComponentHealth {
+			var h ComponentHealth
+			h, token = checkSPRAPI(ctx)
+			return h
+		})
+		token.Latency = api.Latency
+	}()
+	go func() {
+		defer wg.Done()
+		bus = timedCheck(checkSprbus)
+	}()
+	wg.Wait()
+
+	report := HealthReport{
+		Healthy:    true,
+		Checked:    time.Now().UTC(),
+		Components: []ComponentHealth{tsd, api, token, bus},
+	}
+	for _, component := range report.Components {
+		if !component.Healthy {
+			report.Healthy = false
+		}
+	}
+
+	gHealth.record(report)
+	return report
+}
+
+// liveness narrows a full report down to the components /healthz cares about
+func (report HealthReport) liveness() HealthReport {
+	live := HealthReport{Healthy: true, Checked: report.Checked, Components: []ComponentHealth{}}
+	for _, component := range report.Components {
+		for _, name := range livenessComponents {
+			if component.Name != name {
+				continue
+			}
+			live.Components = append(live.Components, component)
+			if !component.Healthy {
+				live.Healthy = false
+			}
+		}
+	}
+	return live
+}
+
+// remembers the last state of each component to publish transitions
+type healthMonitor struct {
+	mtx  sync.Mutex
+	last map[string]bool
+}
+
+var gHealth = &healthMonitor{last: map[string]bool{}}
+
+func (hm *healthMonitor) record(report HealthReport) {
+	changed := []ComponentHealth{}
+
+	hm.mtx.Lock()
+	for _, component := range report.Components {
+		if was, seen := hm.last[component.Name]; !seen || was != component.Healthy {
+			hm.last[component.Name] = component.Healthy
+			changed = append(changed, component)
+		}
+	}
+	hm.mtx.Unlock()
+
+	for _, component := range changed {
+		if component.Healthy {
+			fmt.Println("[+] Health:", component.Name, "is healthy")
+		} else {
+			fmt.Println("[-] Health:", component.Name, "is unhealthy:", component.Error)
+		}
+		//sprbus itself may be the component that failed
+		if err := sprbus.Publish("tailscale:health", component); err != nil {
+			fmt.Println("[-] Failed to publish health change", err)
+		}
+		publishEvent(EventHealth, component)
+	}
+}
+
+func startHealthMonitor() {
+	go func() {
+		for {
+			checkHealth()
+			time.Sleep(HealthCheckInterval)
+		}
+	}()
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (tsp *tailscalePlugin) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, checkHealth().liveness())
+}
+
+func (tsp *tailscalePlugin) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, checkHealth())
+}
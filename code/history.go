@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// every config write keeps a snapshot of what was written under
+// ConfigHistoryDir, along with a short diff against the previous version.
+// POST /config/rollback/{id} writes a snapshot back, which is itself recorded.
+
+var ConfigHistoryDir = TEST_PREFIX + "/configs/spr-tailscale/history"
+
+// snapshots beyond this many are pruned, oldest first
+var ConfigHistoryLimit = 50
+
+// diff lines beyond this many are summarized
+var configDiffLimit = 12
+
+// fields whose values never appear in a diff
+var configSecretFields = []string{"TailscaleAuthKey", "APIToken"}
+
+type ConfigSnapshot struct {
+	ID     string
+	Time   time.Time
+	Diff   []string
+	Config *Config `json:",omitempty"`
+}
+
+func shortJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	if len(data) > 60 {
+		return string(data[:57]) + "..."
+	}
+	return string(data)
+}
+
+func diffValues(path string, a interface{}, b interface{}, out *[]string) {
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+
+	name := path
+	if idx := strings.LastIndex(path, "."); idx >= 0 {
+		name = path[idx+1:]
+	}
+	if slices.Contains(configSecretFields, name) {
+		*out = append(*out, path+" changed")
+		return
+	}
+
+	mapA, okA := a.(map[string]interface{})
+	mapB, okB := b.(map[string]interface{})
+	if okA && okB {
+		keys := []string{}
+		for key := range mapA {
+			keys = append(keys, key)
+		}
+		for key := range mapB {
+			if _, exists := mapA[key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			diffValues(child, mapA[key], mapB[key], out)
+		}
+		return
+	}
+
+	listA, okA := a.([]interface{})
+	listB, okB := b.([]interface{})
+	if okA && okB && len(listA) == len(listB) {
+		for idx := range listA {
+			diffValues(fmt.Sprintf("%s[%d]", path, idx), listA[idx], listB[idx], out)
+		}
+		return
+	}
+
+	*out = append(*out, path+": "+shortJSON(a)+" -> "+shortJSON(b))
+}
+
+// diffConfig describes what changed between two configs, one line per field
+func diffConfig(old []byte, new []byte) []string {
+	//round trip the old file through Config so fields it lacks compare as zero values
+	oldCfg := Config{}
+	json.Unmarshal(old, &oldCfg)
+	old, _ = json.Marshal(oldCfg)
+
+	var a, b interface{}
+	json.Unmarshal(old, &a)
+	json.Unmarshal(new, &b)
+
+	diff := []string{}
+	diffValues("", a, b, &diff)
+	if len(diff) > configDiffLimit {
+		more := len(diff) - configDiffLimit
+		diff = append(diff[:configDiffLimit], fmt.Sprintf("... and %d more changes", more))
+	}
+	return diff
+}
+
+func writeConfigSnapshot(snapshot ConfigSnapshot) error {
+	if err := os.MkdirAll(ConfigHistoryDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snapshot, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(ConfigHistoryDir, snapshot.ID+".json"), data, 0600)
+}
+
+// snapshot IDs, oldest first
+func listConfigSnapshotIDs() []string {
+	ids := []string{}
+	files, err := os.ReadDir(ConfigHistoryDir)
+	if err != nil {
+		return ids
+	}
+	for _, file := range files {
+		if name := file.Name(); strings.HasSuffix(name, ".json") {
+			ids = append(ids, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func readConfigSnapshot(id string) (ConfigSnapshot, error) {
+	snapshot := ConfigSnapshot{}
+	// ids are generated by us, refuse anything that could leave the directory
+	if id == "" || strings.ContainsAny(id, "/\\") || strings.Contains(id, "..") {
+		return snapshot, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ConfigHistoryDir, id+".json"))
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+// recordConfigHistory is called by writeConfigLocked with the file contents
+// before and after the write
+func recordConfigHistory(old []byte, new []byte) {
+	ids := listConfigSnapshotIDs()
+
+	now := time.Now().UTC()
+	if len(ids) == 0 && len(old) > 0 {
+		//keep what was there before history started as a baseline
+		baseline := Config{}
+		if json.Unmarshal(old, &baseline) == nil {
+			snapshot := ConfigSnapshot{
+				ID:     now.Add(-time.Microsecond).Format("20060102T150405.000000Z"),
+				Time:   now,
+				Diff:   []string{"initial"},
+				Config: &baseline,
+			}
+			if err := writeConfigSnapshot(snapshot); err != nil {
+				fmt.Println("[-] Failed to save config history", err)
+			}
+		}
+	}
+
+	cfg := Config{}
+	json.Unmarshal(new, &cfg)
+	snapshot := ConfigSnapshot{
+		ID:     now.Format("20060102T150405.000000Z"),
+		Time:   now,
+		Diff:   diffConfig(old, new),
+		Config: &cfg,
+	}
+	if err := writeConfigSnapshot(snapshot); err != nil {
+		fmt.Println("[-] Failed to save config history", err)
+		return
+	}
+
+	ids = listConfigSnapshotIDs()
+	for len(ids) > ConfigHistoryLimit {
+		os.Remove(filepath.Join(ConfigHistoryDir, ids[0]+".json"))
+		ids = ids[1:]
+	}
+}
+
+// GET /config/history lists snapshots newest first, without their contents
+func (tsp *tailscalePlugin) handleGetConfigHistory(w http.ResponseWriter, r *http.Request) {
+	Configmtx.RLock()
+	ids := listConfigSnapshotIDs()
+	Configmtx.RUnlock()
+
+	history := []ConfigSnapshot{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		snapshot, err := readConfigSnapshot(ids[i])
+		if err != nil {
+			continue
+		}
+		snapshot.Config = nil
+		history = append(history, snapshot)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		httpInternalError("Encoding config history failed", err, w)
+		return
+	}
+}
+
+// POST /config/rollback/{id} restores a snapshot. the current API token and
+// down state are kept, they describe this installation rather than the config
+func (tsp *tailscalePlugin) handleConfigRollback(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	//same order as handleSetExitNode, which saves the config holding clientMtx
+	tsp.clientMtx.Lock()
+	Configmtx.Lock()
+	ok := tsp.restoreConfigLocked(w, r, id)
+	Configmtx.Unlock()
+	tsp.clientMtx.Unlock()
+	if !ok {
+		return
+	}
+
+	//takes both locks itself
+	tsp.publishDNSZone(r.Context())
+	requestRebuild("api:config/rollback")
+}
+
+// restoreConfigLocked replaces gConfig with snapshot id. the exit node and
+// DNS forwarder are switched the way /exitnode and /dns do before the config
+// is saved, and switched back if that fails. errors are written to w
+func (tsp *tailscalePlugin) restoreConfigLocked(w http.ResponseWriter, r *http.Request, id string) bool {
+	snapshot, err := readConfigSnapshot(id)
+	if err != nil || snapshot.Config == nil {
+		http.Error(w, "Not found", 404)
+		return false
+	}
+
+	//snapshots written by an older version need the same migrations as config.json
+	data, _ := json.Marshal(snapshot.Config)
+	upgraded, _, err := migrateConfig(data)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+	restored := Config{}
+	if err := json.Unmarshal(upgraded, &restored); err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+	restored.APIToken = gConfig.APIToken
+	restored.AdministrativelyDown = gConfig.AdministrativelyDown
+	if os.Getenv("VIRTUAL_SPR") == "1" {
+		//exit node routing is not supported, see handleSetExitNode
+		restored.ExitNode = gConfig.ExitNode
+	}
+	if err := validateConfig(&restored); err != nil {
+		httpValidationError(err, w)
+		return false
+	}
+
+	previous := gConfig
+	dnsChanged := restored.DNSForwarder != previous.DNSForwarder
+	exitChanged := restored.ExitNode.StableID != previous.ExitNode.StableID
+
+	if dnsChanged {
+		if err := tsp.setDNSForwarding(restored.DNSForwarder); err != nil {
+			httpInternalError("Starting DNS forwarder failed", err, w)
+			return false
+		}
+	}
+	if exitChanged {
+		if err := tsp.setExitNodePrefs(r.Context(), restored.ExitNode); err != nil {
+			if dnsChanged {
+				tsp.setDNSForwarding(previous.DNSForwarder)
+			}
+			httpInternalError("Changing exit node failed", err, w)
+			return false
+		}
+	}
+
+	gConfig = restored
+	err = writeConfigLocked(r.Context())
+	if err == nil {
+		err = writeTailscaleEnvLocked()
+	}
+	if err != nil {
+		gConfig = previous
+		writeConfigLocked(r.Context())
+		writeTailscaleEnvLocked()
+		if exitChanged {
+			tsp.setExitNodePrefs(r.Context(), previous.ExitNode)
+		}
+		if dnsChanged {
+			tsp.setDNSForwarding(previous.DNSForwarder)
+		}
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfigJSON(t *testing.T, cfg Config) []byte {
+	data, err := json.MarshalIndent(cfg, "", " ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDiffConfig(t *testing.T) {
+	manyPeers := func(ip string) Config {
+		cfg := Config{}
+		for i := 0; i < 20; i++ {
+			cfg.Peers = append(cfg.Peers, TailscalePeer{StableID: fmt.Sprintf("n%d", i), IP: ip})
+		}
+		return cfg
+	}
+
+	tests := []struct {
+		name string
+		old  []byte
+		new  []byte
+		want []string
+	}{
+		{
+			name: "no changes",
+			old:  testConfigJSON(t, Config{Version: 1, DNSForwarder: true}),
+			new:  testConfigJSON(t, Config{Version: 1, DNSForwarder: true}),
+			want: []string{},
+		},
+		{
+			name: "fields missing from an old file compare as zero values",
+			old:  []byte(`{"Version": 1}`),
+			new:  testConfigJSON(t, Config{Version: 1}),
+			want: []string{},
+		},
+		{
+			name: "changed fields are listed by path in order",
+			old:  testConfigJSON(t, Config{Version: 1}),
+			new:  testConfigJSON(t, Config{Version: 1, DNSForwarder: true, AdvertiseExitNode: true}),
+			want: []string{"AdvertiseExitNode: false -> true", "DNSForwarder: false -> true"},
+		},
+		{
+			name: "list entries of the same length are compared element-wise",
+			old:  testConfigJSON(t, Config{Peers: []TailscalePeer{{StableID: "nlaptop", Groups: []string{"lab"}}}}),
+			new:  testConfigJSON(t, Config{Peers: []TailscalePeer{{StableID: "nlaptop", Groups: []string{"wan"}}}}),
+			want: []string{`Peers[0].Groups[0]: "lab" -> "wan"`},
+		},
+		{
+			name: "lists of different lengths are shown whole",
+			old:  testConfigJSON(t, Config{DefaultGroups: []string{"lab"}}),
+			new:  testConfigJSON(t, Config{DefaultGroups: []string{"lab", "tailnet"}}),
+			want: []string{`DefaultGroups: ["lab"] -> ["lab","tailnet"]`},
+		},
+		{
+			name: "map entries are keyed by name",
+			old:  testConfigJSON(t, Config{RouteImports: map[string][]string{"remote": {"10.0.0.0/8"}}}),
+			new:  testConfigJSON(t, Config{RouteImports: map[string][]string{"remote": {"10.1.0.0/16"}}}),
+			want: []string{`RouteImports.remote[0]: "10.0.0.0/8" -> "10.1.0.0/16"`},
+		},
+		{
+			name: "secrets never appear",
+			old:  testConfigJSON(t, Config{TailscaleAuthKey: "tskey-old", APIToken: "old"}),
+			new:  testConfigJSON(t, Config{TailscaleAuthKey: "tskey-new", APIToken: "new"}),
+			want: []string{"APIToken changed", "TailscaleAuthKey changed"},
+		},
+		{
+			name: "long values are shortened",
+			old:  testConfigJSON(t, Config{ExitNode: ExitNodeConfig{StableID: strings.Repeat("a", 80)}}),
+			new:  testConfigJSON(t, Config{ExitNode: ExitNodeConfig{StableID: "nexit"}}),
+			want: []string{`ExitNode.StableID: "` + strings.Repeat("a", 56) + `... -> "nexit"`},
+		},
+		{
+			name: "changes beyond the limit are summarized",
+			old:  testConfigJSON(t, manyPeers("")),
+			new:  testConfigJSON(t, manyPeers("100.64.0.1")),
+			want: func() []string {
+				lines := []string{}
+				for i := 0; i < configDiffLimit; i++ {
+					lines = append(lines, fmt.Sprintf(`Peers[%d].IP: "" -> "100.64.0.1"`, i))
+				}
+				return append(lines, fmt.Sprintf("... and %d more changes", 20-configDiffLimit))
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffConfig(tt.old, tt.new)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("diffConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// points the config and its history at a temporary directory for one test
+func useTestConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	configFile, envFile, historyDir, cfg := ConfigFile, TailscaleEnvFile, ConfigHistoryDir, gConfig
+	ConfigFile = dir + "/config.json"
+	TailscaleEnvFile = dir + "/config.sh"
+	ConfigHistoryDir = dir + "/history"
+	t.Cleanup(func() {
+		ConfigFile, TailscaleEnvFile, ConfigHistoryDir, gConfig = configFile, envFile, historyDir, cfg
+	})
+}
+
+func TestRestoreConfig(t *testing.T) {
+	if err := registerValidators(); err != nil {
+		t.Fatal(err)
+	}
+
+	current := Config{
+		Version:              ConfigVersion,
+		APIToken:             "current-token",
+		AdministrativelyDown: true,
+		Peers:                []TailscalePeer{{StableID: "nphone", Groups: []string{"lab"}, Policies: []string{}}},
+	}
+
+	tests := []struct {
+		name     string
+		id       string
+		snapshot *Config
+		code     int
+		// the NodeKey of the restored peer, empty when gConfig is left alone
+		nodeKey string
+	}{
+		{
+			name: "unknown snapshot",
+			id:   "20240101T000000.000000Z",
+			code: 404,
+		},
+		{
+			name: "ids cannot leave the history directory",
+			id:   "../config",
+			code: 404,
+		},
+		{
+			name: "older snapshots are migrated and keep this installation's token and down state",
+			id:   "20240101T000000.000000Z",
+			snapshot: &Config{
+				APIToken: "old-token",
+				Peers:    []TailscalePeer{{StableID: "nlaptop", NodeKey: "nodekey:abc", Groups: []string{"tailnet"}, Policies: []string{}}},
+			},
+			code:    200,
+			nodeKey: "abc",
+		},
+		{
+			name: "invalid snapshots are refused",
+			id:   "20240101T000000.000000Z",
+			snapshot: &Config{
+				Version: ConfigVersion,
+				Peers:   []TailscalePeer{{StableID: "nlaptop", Policies: []string{"everything"}}},
+			},
+			code: 400,
+		},
+		{
+			name:     "snapshots from a newer version are refused",
+			id:       "20240101T000000.000000Z",
+			snapshot: &Config{Version: ConfigVersion + 1},
+			code:     400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfigFiles(t)
+			gConfig = current
+			if tt.snapshot != nil {
+				err := writeConfigSnapshot(ConfigSnapshot{ID: tt.id, Time: time.Now(), Diff: []string{}, Config: tt.snapshot})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/config/rollback/"+tt.id, nil)
+			tsp := &tailscalePlugin{}
+			ok := tsp.restoreConfigLocked(w, r, tt.id)
+			if ok != (tt.code == 200) || w.Code != tt.code {
+				t.Fatalf("restoreConfigLocked() = %v with %d, want %d: %s", ok, w.Code, tt.code, w.Body.String())
+			}
+
+			if tt.nodeKey == "" {
+				if gConfig.APIToken != current.APIToken || len(gConfig.Peers) != 1 || gConfig.Peers[0].StableID != "nphone" {
+					t.Errorf("gConfig = %+v, want it unchanged", gConfig)
+				}
+				return
+			}
+			if len(gConfig.Peers) != 1 || gConfig.Peers[0].NodeKey != tt.nodeKey {
+				t.Errorf("Peers = %+v, want NodeKey %q", gConfig.Peers, tt.nodeKey)
+			}
+			if gConfig.Version != ConfigVersion {
+				t.Errorf("Version = %d, want %d", gConfig.Version, ConfigVersion)
+			}
+			if gConfig.APIToken != current.APIToken || !gConfig.AdministrativelyDown {
+				t.Errorf("APIToken = %q, AdministrativelyDown = %v, want the current ones", gConfig.APIToken, gConfig.AdministrativelyDown)
+			}
+
+			//the restored config is written and the rollback itself is recorded
+			saved := Config{}
+			data, err := os.ReadFile(ConfigFile)
+			if err == nil {
+				err = json.Unmarshal(data, &saved)
+			}
+			if err != nil || len(saved.Peers) != 1 || saved.Peers[0].StableID != "nlaptop" {
+				t.Errorf("config.json = %+v, %v", saved, err)
+			}
+			if ids := listConfigSnapshotIDs(); len(ids) != 2 {
+				t.Errorf("history = %q, want the snapshot and the rollback", ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	sprbus "github.com/spr-networks/sprbus-json"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// tailscaled tells us about peers joining, leaving and readdressing on the
+// IPN bus. we keep a cached Status from it for the read-only handlers and
+// kick the reconciler whenever the peer set changes.
+
+// how long a cached status is served before falling back to tailscaled
+var StatusCacheMaxAge = 10 * time.Second
+
+// StableNodeID -> everything reconciliation derives from a peer: its IPs,
+// routes, tags, owner, hostname and OS. a change in any of them is worth
+// reconciling
+func peerFingerprint(status *ipnstate.Status) map[string]string {
+	fp := map[string]string{}
+	for _, peer := range status.Peer {
+		ips := []string{}
+		for _, ip := range peer.TailscaleIPs {
+			ips = append(ips, ip.String())
+		}
+		slices.Sort(ips)
+
+		routes := []string{}
+		if peer.PrimaryRoutes != nil {
+			for _, route := range peer.PrimaryRoutes.All() {
+				routes = append(routes, route.String())
+			}
+		}
+		slices.Sort(routes)
+
+		tags := []string{}
+		if peer.Tags != nil {
+			tags = peer.Tags.AsSlice()
+		}
+		slices.Sort(tags)
+
+		fp[string(peer.ID)] = strings.Join([]string{
+			strings.Join(ips, ","),
+			strings.Join(routes, ","),
+			strings.Join(tags, ","),
+			fmt.Sprint(peer.UserID),
+			peer.HostName,
+			peer.OS,
+		}, "|")
+	}
+	return fp
+}
+
+func (tsp *tailscalePlugin) storeStatus(status *ipnstate.Status) {
+	tsp.statusMtx.Lock()
+	tsp.status = status
+	tsp.statusAt = time.Now()
+	tsp.statusMtx.Unlock()
+}
+
+// cachedStatus returns the status kept fresh by the IPN bus watcher, or asks
+// tailscaled directly if the cache is stale. callers must hold clientMtx.
+func (tsp *tailscalePlugin) cachedStatus(ctx context.Context) (*ipnstate.Status, error) {
+	tsp.statusMtx.Lock()
+	status := tsp.status
+	fresh := status != nil && time.Since(tsp.statusAt) < StatusCacheMaxAge
+	tsp.statusMtx.Unlock()
+
+	if fresh {
+		return status, nil
+	}
+
+	status, err := tsp.tsdClient.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tsp.storeStatus(status)
+	return status, nil
+}
+
+func (tsp *tailscalePlugin) watchIPNBusOnce(ctx context.Context) error {
+	client := tailscale.LocalClient{
+		Socket:        UNIX_TAILSCALE_SOCK,
+		UseSocketOnly: true,
+	}
+
+	watcher, err := client.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyInitialStatus|ipn.NotifyPeerChanges|ipn.NotifyRateLimit)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	lastState := ""
+	var lastPeers map[string]string
+	lastOnline := map[string]bool{}
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+
+		if n.State != nil && n.State.String() != lastState {
+			lastState = n.State.String()
+			sprbus.Publish("tailscale:state", map[string]string{"State": lastState})
+			publishEvent(EventState, map[string]string{"State": lastState})
+			if lastState == "Running" {
+				requestRebuild("ipn:running")
+				//the MagicDNS zone is only known once logged in
+				Configmtx.RLock()
+				forwarding := gConfig.DNSForwarder
+				Configmtx.RUnlock()
+				if forwarding {
+					tsp.publishDNSZone(ctx)
+				}
+			}
+		}
+
+		if n.BrowseToURL != nil && *n.BrowseToURL != "" {
+			publishEvent(EventLogin, map[string]string{"State": lastState, "AuthURL": *n.BrowseToURL})
+		}
+		if n.LoginFinished != nil {
+			publishEvent(EventLogin, map[string]string{"State": lastState, "Message": "login finished"})
+		}
+		if n.ErrMessage != nil {
+			publishEvent(EventLogin, map[string]string{"State": lastState, "Error": *n.ErrMessage})
+		}
+
+		if n.InitialStatus == nil && n.SelfChange == nil && n.PeersChanged == nil && n.PeersRemoved == nil {
+			continue
+		}
+
+		status := n.InitialStatus
+		if status == nil {
+			status, err = client.Status(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		tsp.storeStatus(status)
+
+		for _, peer := range status.Peer {
+			id := string(peer.ID)
+			if was, seen := lastOnline[id]; !seen || was != peer.Online {
+				lastOnline[id] = peer.Online
+				//peers in the first status are not transitions, peers joining later are
+				if seen || lastPeers != nil {
+					event := PeerEvent{StableID: id, HostName: peer.HostName, Online: peer.Online}
+					if len(peer.TailscaleIPs) > 0 {
+						event.IP = peer.TailscaleIPs[0].String()
+					}
+					publishEvent(EventPeer, event)
+				}
+			}
+		}
+
+		peers := peerFingerprint(status)
+		if lastPeers == nil || !maps.Equal(peers, lastPeers) {
+			lastPeers = peers
+			requestRebuild("ipn:peers")
+		}
+	}
+}
+
+// watchIPNBus follows tailscaled for the lifetime of the plugin, reconnecting
+// when it restarts
+func (tsp *tailscalePlugin) watchIPNBus() {
+	for {
+		err := tsp.watchIPNBusOnce(context.Background())
+		fmt.Println("[-] IPN bus watch ended, retrying", err)
+		time.Sleep(3 * time.Second)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// GET /metrics serves the Prometheus text exposition format. peer and route
+// figures are read from tailscaled at scrape time, through the status cache.
+// reconcile and SPR API figures, and the SPR rule count, are recorded as
+// reconciliation runs so a scrape never calls the SPR API.
+
+// upper bounds of the reconcile duration histogram buckets, in seconds
+var ReconcileDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricCounters struct {
+	mtx sync.Mutex
+
+	reconcileRuns     uint64
+	reconcileFailures uint64
+	reconcileSeconds  float64
+	lastReconcile     float64
+	// per bucket of ReconcileDurationBuckets, not cumulative
+	reconcileBuckets []uint64
+
+	// GeneratedTailscale-* rules SPR had when the last pass read them, -1
+	// before the first pass
+	generatedRules int
+
+	// status code, or "error" when no response came back
+	sprAPIErrors map[string]uint64
+}
+
+var gMetrics = newMetricCounters()
+
+func newMetricCounters() *metricCounters {
+	return &metricCounters{
+		reconcileBuckets: make([]uint64, len(ReconcileDurationBuckets)),
+		generatedRules:   -1,
+		sprAPIErrors:     map[string]uint64{},
+	}
+}
+
+func (m *metricCounters) observeReconcile(duration time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.reconcileRuns++
+	if err != nil {
+		m.reconcileFailures++
+	}
+	m.reconcileSeconds += duration.Seconds()
+	m.lastReconcile = duration.Seconds()
+	for idx, bound := range ReconcileDurationBuckets {
+		if duration.Seconds() <= bound {
+			m.reconcileBuckets[idx]++
+			break
+		}
+	}
+}
+
+func (m *metricCounters) observeGeneratedRules(rules []CustomInterfaceRule) {
+	count := 0
+	for _, entry := range rules {
+		if entry.Interface == gSPRTailscaleInterface && strings.HasPrefix(entry.RuleName, GeneratedRulePrefix) {
+			count++
+		}
+	}
+	m.mtx.Lock()
+	m.generatedRules = count
+	m.mtx.Unlock()
+}
+
+// countSPRAPIError records a failed call to the SPR API. statusCode is 0 when
+// the request never got a response
+func countSPRAPIError(statusCode int) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	gMetrics.mtx.Lock()
+	gMetrics.sprAPIErrors[code]++
+	gMetrics.mtx.Unlock()
+}
+
+// label values need backslash, quote and newline escaped
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+type metricWriter struct {
+	w io.Writer
+}
+
+func (mw metricWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels are given as name, value pairs
+func (mw metricWriter) sample(name string, value float64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(mw.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+		return
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	fmt.Fprintf(mw.w, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func peerMetricLabels(peer *ipnstate.PeerStatus) []string {
+	ip := ""
+	if len(peer.TailscaleIPs) > 0 {
+		ip = peer.TailscaleIPs[0].String()
+	}
+	return []string{"stable_id", string(peer.ID), "hostname", peer.HostName, "ip", ip}
+}
+
+func (tsp *tailscalePlugin) writeTailscaleMetrics(mw metricWriter) {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+	defer cancel()
+
+	tsp.clientMtx.Lock()
+	defer tsp.clientMtx.Unlock()
+
+	mw.header("tailscale_up", "gauge", "Whether tailscaled answered, now or within the status cache age.")
+	status, err := tsp.cachedStatus(ctx)
+	if err != nil {
+		fmt.Println("[-] metrics: failed to get tailscale status", err)
+		mw.sample("tailscale_up", 0)
+		return
+	}
+	mw.sample("tailscale_up", 1)
+
+	tsp.statusMtx.Lock()
+	age := time.Since(tsp.statusAt)
+	tsp.statusMtx.Unlock()
+	mw.header("tailscale_status_age_seconds", "gauge", "Age of the cached tailscaled status the peer figures come from.")
+	mw.sample("tailscale_status_age_seconds", age.Seconds())
+
+	online := 0
+	for _, peer := range status.Peer {
+		if peer.Online {
+			online++
+		}
+	}
+	mw.header("tailscale_peers", "gauge", "Tailnet peers by online state.")
+	mw.sample("tailscale_peers", float64(online), "online", "true")
+	mw.sample("tailscale_peers", float64(len(status.Peer)-online), "online", "false")
+
+	mw.header("tailscale_peer_rx_bytes_total", "counter", "Bytes received from each peer.")
+	for _, key := range status.Peers() {
+		peer := status.Peer[key]
+		mw.sample("tailscale_peer_rx_bytes_total", float64(peer.RxBytes), peerMetricLabels(peer)...)
+	}
+	mw.header("tailscale_peer_tx_bytes_total", "counter", "Bytes sent to each peer.")
+	for _, key := range status.Peers() {
+		peer := status.Peer[key]
+		mw.sample("tailscale_peer_tx_bytes_total", float64(peer.TxBytes), peerMetricLabels(peer)...)
+	}
+
+	if status.Self != nil && status.Self.KeyExpiry != nil {
+		mw.header("tailscale_key_expiry_timestamp_seconds", "gauge", "When this node's key expires, as a unix timestamp.")
+		mw.sample("tailscale_key_expiry_timestamp_seconds", float64(status.Self.KeyExpiry.Unix()))
+	}
+
+	prefs, err := tsp.tsdClient.GetPrefs(ctx)
+	if err != nil {
+		fmt.Println("[-] metrics: failed to get tailscale prefs", err)
+		return
+	}
+	routes := 0
+	exitNode := 0
+	for _, prefix := range prefs.AdvertiseRoutes {
+		if prefix.Bits() == 0 {
+			exitNode = 1
+			continue
+		}
+		routes++
+	}
+	mw.header("tailscale_advertised_routes", "gauge", "Subnet routes advertised to the tailnet.")
+	mw.sample("tailscale_advertised_routes", float64(routes))
+	mw.header("tailscale_advertised_exit_node", "gauge", "Whether this node offers itself as an exit node.")
+	mw.sample("tailscale_advertised_exit_node", float64(exitNode))
+}
+
+func (m *metricCounters) write(mw metricWriter) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	mw.header("tailscale_reconcile_runs_total", "counter", "Reconciliation passes run.")
+	mw.sample("tailscale_reconcile_runs_total", float64(m.reconcileRuns))
+	mw.header("tailscale_reconcile_failures_total", "counter", "Reconciliation passes that returned an error.")
+	mw.sample("tailscale_reconcile_failures_total", float64(m.reconcileFailures))
+	mw.header("tailscale_reconcile_duration_seconds", "histogram", "Duration of reconciliation passes.")
+	cumulative := uint64(0)
+	for idx, bound := range ReconcileDurationBuckets {
+		cumulative += m.reconcileBuckets[idx]
+		mw.sample("tailscale_reconcile_duration_seconds_bucket", float64(cumulative), "le", strconv.FormatFloat(bound, 'g', -1, 64))
+	}
+	mw.sample("tailscale_reconcile_duration_seconds_bucket", float64(m.reconcileRuns), "le", "+Inf")
+	mw.sample("tailscale_reconcile_duration_seconds_sum", m.reconcileSeconds)
+	mw.sample("tailscale_reconcile_duration_seconds_count", float64(m.reconcileRuns))
+	mw.header("tailscale_reconcile_last_duration_seconds", "gauge", "Duration of the last reconciliation pass.")
+	mw.sample("tailscale_reconcile_last_duration_seconds", m.lastReconcile)
+
+	if m.generatedRules >= 0 {
+		mw.header("tailscale_generated_rules", "gauge", "GeneratedTailscale-* rules installed in SPR, as of the last reconciliation.")
+		mw.sample("tailscale_generated_rules", float64(m.generatedRules))
+	}
+
+	codes := []string{}
+	for code := range m.sprAPIErrors {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	mw.header("tailscale_spr_api_errors_total", "counter", "Failed SPR API calls by status code, \"error\" when there was no response.")
+	for _, code := range codes {
+		mw.sample("tailscale_spr_api_errors_total", float64(m.sprAPIErrors[code]), "code", code)
+	}
+}
+
+func (tsp *tailscalePlugin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	mw := metricWriter{w: w}
+	tsp.writeTailscaleMetrics(mw)
+	gMetrics.write(mw)
+}
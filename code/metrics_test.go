@@ -0,0 +1,47 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileMetrics(t *testing.T) {
+	m := newMetricCounters()
+	for _, duration := range []time.Duration{50 * time.Millisecond, 300 * time.Millisecond, 2 * time.Second, 2 * time.Minute} {
+		m.observeReconcile(duration, nil)
+	}
+	m.observeGeneratedRules([]CustomInterfaceRule{
+		newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+		newManagedPeerRule("100.64.0.2", []string{}, []string{"lab"}, testContainerIP),
+		{BaseRule: BaseRule{RuleName: GeneratedRulePrefix + "100.64.0.9"}, Interface: "wg0", SrcIP: "100.64.0.9"},
+		{BaseRule: BaseRule{RuleName: "by-hand"}, Interface: gSPRTailscaleInterface, SrcIP: "100.64.0.8"},
+	})
+
+	out := strings.Builder{}
+	m.write(metricWriter{w: &out})
+	lines := strings.Split(out.String(), "\n")
+
+	for _, want := range []string{
+		`tailscale_reconcile_duration_seconds_bucket{le="0.1"} 1`,
+		`tailscale_reconcile_duration_seconds_bucket{le="0.25"} 1`,
+		`tailscale_reconcile_duration_seconds_bucket{le="0.5"} 2`,
+		`tailscale_reconcile_duration_seconds_bucket{le="2.5"} 3`,
+		`tailscale_reconcile_duration_seconds_bucket{le="60"} 3`,
+		`tailscale_reconcile_duration_seconds_bucket{le="+Inf"} 4`,
+		`tailscale_reconcile_duration_seconds_sum 122.35`,
+		`tailscale_reconcile_duration_seconds_count 4`,
+		`tailscale_generated_rules 2`,
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+
+	fresh := strings.Builder{}
+	newMetricCounters().write(metricWriter{w: &fresh})
+	if strings.Contains(fresh.String(), "tailscale_generated_rules") {
+		t.Error("rule count reported before the first reconciliation")
+	}
+}
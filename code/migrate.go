@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// config.json carries a Version. loadConfig runs every migration between the
+// file's version and ConfigVersion on the raw JSON, after backing the file up,
+// so fields can change shape without losing data.
+
+const ConfigVersion = 1
+
+var errConfigTooNew = errors.New("config.json is newer than this plugin")
+var errConfigVersionInvalid = errors.New("config.json has an invalid version")
+
+// configMigrations[n] upgrades a version n config to n+1
+var configMigrations = []func(map[string]interface{}) error{
+	migrateConfigV0,
+}
+
+// v0 had no Version and NodeKeys were stored as sent by the UI, with or
+// without the "nodekey:" prefix
+func migrateConfigV0(raw map[string]interface{}) error {
+	peers, _ := raw["Peers"].([]interface{})
+	for _, entry := range peers {
+		peer, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if key, ok := peer["NodeKey"].(string); ok {
+			peer["NodeKey"] = strings.TrimPrefix(key, "nodekey:")
+		}
+	}
+	return nil
+}
+
+func configFileVersion(raw map[string]interface{}) int {
+	version, _ := raw["Version"].(float64)
+	return int(version)
+}
+
+// migrateConfig upgrades data to ConfigVersion. it returns the upgraded JSON
+// and the version the data started at.
+func migrateConfig(data []byte) ([]byte, int, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	from := configFileVersion(raw)
+	if from < 0 {
+		return nil, from, fmt.Errorf("%w: version %d", errConfigVersionInvalid, from)
+	}
+	if from > ConfigVersion {
+		return nil, from, fmt.Errorf("%w: version %d, supported %d", errConfigTooNew, from, ConfigVersion)
+	}
+
+	for version := from; version < ConfigVersion; version++ {
+		if err := configMigrations[version](raw); err != nil {
+			return nil, from, fmt.Errorf("config migration from version %d failed: %w", version, err)
+		}
+		raw["Version"] = version + 1
+	}
+
+	upgraded, err := json.Marshal(raw)
+	return upgraded, from, err
+}
+
+func backupConfigFile(data []byte, version int) error {
+	return ioutil.WriteFile(fmt.Sprintf("%s.v%d.bak", ConfigFile, version), data, 0600)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		from     int
+		nodeKeys []string
+		err      error
+	}{
+		{
+			name:     "v0 node keys lose the nodekey: prefix",
+			data:     `{"Peers": [{"NodeKey": "nodekey:abc"}, {"NodeKey": "def"}]}`,
+			from:     0,
+			nodeKeys: []string{"abc", "def"},
+		},
+		{
+			name:     "current version is left as is",
+			data:     `{"Version": 1, "Peers": [{"NodeKey": "abc"}]}`,
+			from:     1,
+			nodeKeys: []string{"abc"},
+		},
+		{
+			name: "newer versions are refused",
+			data: `{"Version": 99}`,
+			from: 99,
+			err:  errConfigTooNew,
+		},
+		{
+			name: "negative versions are refused",
+			data: `{"Version": -1, "Peers": [{"NodeKey": "nodekey:abc"}]}`,
+			from: -1,
+			err:  errConfigVersionInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upgraded, from, err := migrateConfig([]byte(tt.data))
+			if from != tt.from {
+				t.Errorf("from = %d, want %d", from, tt.from)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := Config{}
+			if err := json.Unmarshal(upgraded, &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Version != ConfigVersion {
+				t.Errorf("Version = %d, want %d", cfg.Version, ConfigVersion)
+			}
+			if len(cfg.Peers) != len(tt.nodeKeys) {
+				t.Fatalf("got %d peers, want %d", len(cfg.Peers), len(tt.nodeKeys))
+			}
+			for idx, peer := range cfg.Peers {
+				if peer.NodeKey != tt.nodeKeys[idx] {
+					t.Errorf("Peers[%d].NodeKey = %q, want %q", idx, peer.NodeKey, tt.nodeKeys[idx])
+				}
+			}
+		})
+	}
+
+	if _, _, err := migrateConfig([]byte("not json")); err == nil {
+		t.Error("invalid JSON was accepted")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// /peers/{id}/config is the REST resource for a peer's SPR access. {id} is
+// the peer's StableID, or its tailscale IP. Every mutation is persisted and
+// queues a reconciliation.
+
+// the live status of a peer merged with its stored configuration
+type PeerConfigView struct {
+	StableID string
+	Status   *ipnstate.PeerStatus `json:",omitempty"` //nil when not in the netmap
+	Config   *TailscalePeer       `json:",omitempty"` //nil when not configured
+	Access   peerAccess           //what reconciliation will install
+}
+
+// only the fields present in the body are changed
+type peerConfigPatch struct {
+	Groups   *[]string
+	Policies *[]string
+	Tags     *[]string
+	Profiles *[]string
+	Notes    *string
+}
+
+// index of the stored entry for a peer, or -1
+func findPeerConfigLocked(stableID string, nodeKey string, ip string) int {
+	return findPeerConfig(&gConfig, stableID, nodeKey, ip)
+}
+
+func findPeerConfig(cfg *Config, stableID string, nodeKey string, ip string) int {
+	for idx := range cfg.Peers {
+		if cfg.Peers[idx].Matches(stableID, nodeKey, ip) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// savePeerConfigLocked replaces the entry at idx, or appends it when idx is
+// -1, then persists the config and queues a reconciliation
+func savePeerConfigLocked(ctx context.Context, idx int, peer TailscalePeer, source string) error {
+	if peer.Groups == nil {
+		peer.Groups = []string{}
+	}
+	if peer.Policies == nil {
+		peer.Policies = []string{}
+	}
+
+	if idx < 0 {
+		gConfig.Peers = append(gConfig.Peers, peer)
+	} else {
+		gConfig.Peers[idx] = peer
+	}
+
+	if err := writeConfigLocked(ctx); err != nil {
+		return err
+	}
+	requestRebuild(source)
+	return nil
+}
+
+func deletePeerConfigLocked(ctx context.Context, idx int, source string) error {
+	gConfig.Peers = slices.Delete(gConfig.Peers, idx, idx+1)
+
+	if err := writeConfigLocked(ctx); err != nil {
+		return err
+	}
+	requestRebuild(source)
+	return nil
+}
+
+func peerStatusToTailnetPeer(status *ipnstate.Status, peer *ipnstate.PeerStatus) tailnetPeer {
+	entry := tailnetPeer{
+		StableID: string(peer.ID),
+		NodeKey:  trimNodeKey(peer.PublicKey.String()),
+		Tags:     []string{},
+		HostName: peer.HostName,
+		DNSName:  strings.TrimSuffix(peer.DNSName, "."),
+		OS:       peer.OS,
+	}
+	entry.IPs = []string{}
+	for _, ip := range peer.TailscaleIPs {
+		entry.IPs = append(entry.IPs, ip.String())
+	}
+	if len(entry.IPs) > 0 {
+		entry.IP = entry.IPs[0]
+	}
+	if peer.PrimaryRoutes != nil {
+		for _, route := range peer.PrimaryRoutes.All() {
+			entry.PrimaryRoutes = append(entry.PrimaryRoutes, route.String())
+		}
+	}
+	if peer.Tags != nil {
+		entry.Tags = peer.Tags.AsSlice()
+	}
+	if user, ok := status.User[peer.UserID]; ok {
+		entry.User = user.LoginName
+	}
+	return entry
+}
+
+// findPeerStatus returns the live peer with the given StableID or tailscale IP
+func findPeerStatus(status *ipnstate.Status, id string) *ipnstate.PeerStatus {
+	for _, peer := range status.Peer {
+		if string(peer.ID) == id {
+			return peer
+		}
+		for _, ip := range peer.TailscaleIPs {
+			if ip.String() == id {
+				return peer
+			}
+		}
+	}
+	return nil
+}
+
+func peerConfigViewLocked(status *ipnstate.Status, peer *ipnstate.PeerStatus, stored *TailscalePeer) PeerConfigView {
+	view := PeerConfigView{Status: peer}
+
+	var live tailnetPeer
+	if peer != nil {
+		live = peerStatusToTailnetPeer(status, peer)
+	} else if stored != nil {
+		live = tailnetPeer{StableID: stored.StableID, NodeKey: stored.NodeKey, IP: stored.IP}
+	}
+	view.StableID = live.StableID
+
+	if stored != nil {
+		entry := *stored
+		view.Config = &entry
+	}
+	view.Access = resolvePeerAccess(&gConfig, live)
+	return view
+}
+
+func (tsp *tailscalePlugin) handleGetPeerConfigs(w http.ResponseWriter, r *http.Request) {
+	tsp.clientMtx.Lock()
+	status, err := tsp.cachedStatus(r.Context())
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		httpInternalError("Getting tailscale peers failed", err, w)
+		return
+	}
+
+	Configmtx.RLock()
+	defer Configmtx.RUnlock()
+
+	views := []PeerConfigView{}
+	seen := map[int]bool{}
+	for _, peer := range status.Peer {
+		live := peerStatusToTailnetPeer(status, peer)
+		var stored *TailscalePeer
+		if idx := findPeerConfigLocked(live.StableID, live.NodeKey, live.IP); idx >= 0 {
+			stored = &gConfig.Peers[idx]
+			seen[idx] = true
+		}
+		views = append(views, peerConfigViewLocked(status, peer, stored))
+	}
+
+	//configured peers that are not currently in the netmap
+	for idx := range gConfig.Peers {
+		if !seen[idx] {
+			views = append(views, peerConfigViewLocked(status, nil, &gConfig.Peers[idx]))
+		}
+	}
+
+	slices.SortFunc(views, func(a, b PeerConfigView) int { return strings.Compare(a.StableID, b.StableID) })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(views); err != nil {
+		httpInternalError("Encoding peer config failed", err, w)
+		return
+	}
+}
+
+func (tsp *tailscalePlugin) handlePeerConfig(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	tsp.clientMtx.Lock()
+	status, err := tsp.cachedStatus(r.Context())
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		httpInternalError("Getting tailscale peers failed", err, w)
+		return
+	}
+
+	// identify the peer from the netmap, or from the config if it is offline
+	identity := TailscalePeer{StableID: id, IP: id}
+	peer := findPeerStatus(status, id)
+	if peer != nil {
+		live := peerStatusToTailnetPeer(status, peer)
+		identity = TailscalePeer{StableID: live.StableID, NodeKey: live.NodeKey, IP: live.IP}
+	}
+
+	if r.Method == http.MethodGet {
+		Configmtx.RLock()
+		defer Configmtx.RUnlock()
+	} else {
+		Configmtx.Lock()
+		defer Configmtx.Unlock()
+	}
+
+	idx := -1
+	if peer != nil {
+		idx = findPeerConfigLocked(identity.StableID, identity.NodeKey, identity.IP)
+	} else {
+		for i, entry := range gConfig.Peers {
+			if entry.StableID == id || entry.IP == id {
+				idx = i
+				identity = TailscalePeer{StableID: entry.StableID, NodeKey: entry.NodeKey, IP: entry.IP}
+				break
+			}
+		}
+	}
+
+	if peer == nil && idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		input := TailscalePeer{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		//the identity always comes from the path and the netmap
+		input.StableID = identity.StableID
+		input.NodeKey = identity.NodeKey
+		input.IP = identity.IP
+		if err := validatePeer(&gConfig, &input); err != nil {
+			httpValidationError(err, w)
+			return
+		}
+		if err := savePeerConfigLocked(r.Context(), idx, input, "api:peers/config"); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		idx = findPeerConfigLocked(identity.StableID, identity.NodeKey, identity.IP)
+
+	case http.MethodPatch:
+		patch := peerConfigPatch{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		entry := identity
+		if idx >= 0 {
+			entry = gConfig.Peers[idx]
+		}
+		if patch.Groups != nil {
+			entry.Groups = *patch.Groups
+		}
+		if patch.Policies != nil {
+			entry.Policies = *patch.Policies
+		}
+		if patch.Tags != nil {
+			entry.Tags = *patch.Tags
+		}
+		if patch.Profiles != nil {
+			entry.Profiles = *patch.Profiles
+		}
+		if patch.Notes != nil {
+			entry.Notes = *patch.Notes
+		}
+		if err := validatePeer(&gConfig, &entry); err != nil {
+			httpValidationError(err, w)
+			return
+		}
+		if err := savePeerConfigLocked(r.Context(), idx, entry, "api:peers/config"); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		idx = findPeerConfigLocked(identity.StableID, identity.NodeKey, identity.IP)
+
+	case http.MethodDelete:
+		if idx < 0 {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		if err := deletePeerConfigLocked(r.Context(), idx, "api:peers/config"); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		idx = -1
+	}
+
+	var stored *TailscalePeer
+	if idx >= 0 {
+		stored = &gConfig.Peers[idx]
+	}
+
+	view := peerConfigViewLocked(status, peer, stored)
+	if view.StableID == "" {
+		view.StableID = identity.StableID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(view); err != nil {
+		httpInternalError("Encoding peer config failed", err, w)
+		return
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// bulk export and import of the Peers entries, as JSON or CSV. Every field of
+// TailscalePeer is carried, so an export imported with mode=replace gives back
+// the same entries. In CSV the list columns hold ";" separated lists.
+
+var peerMappingColumns = []string{"StableID", "HostName", "NodeKey", "IP", "Groups", "Policies", "Tags", "Profiles", "Notes"}
+
+type PeerMappingRow struct {
+	StableID string
+	HostName string //from the netmap, only used to match rows
+	NodeKey  string
+	IP       string
+	Groups   []string
+	Policies []string
+	// nil when left out of the import, a merge then keeps the entry's own
+	Tags     []string
+	Profiles []string
+	Notes    string
+}
+
+type ImportRowError struct {
+	Row    int //1-based, not counting the CSV header
+	Peer   PeerMappingRow
+	Reason string
+}
+
+type ImportReport struct {
+	Mode      string
+	Imported  int
+	Unmatched []ImportRowError
+	Invalid   []ImportRowError //rows rejected by validation, not imported
+}
+
+func requestFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+func splitList(field string) []string {
+	list := []string{}
+	for _, item := range strings.Split(field, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func readPeerMappingCSV(body io.Reader) ([]PeerMappingRow, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []PeerMappingRow{}, nil
+	}
+
+	// columns are matched by header name so they can come in any order
+	columns := map[string]int{}
+	for idx, name := range records[0] {
+		columns[strings.TrimSpace(name)] = idx
+	}
+	field := func(record []string, name string) string {
+		idx, ok := columns[name]
+		if !ok || idx >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[idx])
+	}
+	// nil for a missing column, so a merge keeps what is configured
+	optionalList := func(record []string, name string) []string {
+		if _, ok := columns[name]; !ok {
+			return nil
+		}
+		return splitList(field(record, name))
+	}
+
+	rows := []PeerMappingRow{}
+	for _, record := range records[1:] {
+		rows = append(rows, PeerMappingRow{
+			StableID: field(record, "StableID"),
+			HostName: field(record, "HostName"),
+			NodeKey:  field(record, "NodeKey"),
+			IP:       field(record, "IP"),
+			Groups:   splitList(field(record, "Groups")),
+			Policies: splitList(field(record, "Policies")),
+			Tags:     optionalList(record, "Tags"),
+			Profiles: optionalList(record, "Profiles"),
+			Notes:    field(record, "Notes"),
+		})
+	}
+	return rows, nil
+}
+
+func writePeerMappingCSV(w io.Writer, rows []PeerMappingRow) error {
+	writer := csv.NewWriter(w)
+	writer.Write(peerMappingColumns)
+	for _, row := range rows {
+		writer.Write([]string{row.StableID, row.HostName, row.NodeKey, row.IP,
+			strings.Join(row.Groups, ";"), strings.Join(row.Policies, ";"),
+			strings.Join(row.Tags, ";"), strings.Join(row.Profiles, ";"), row.Notes})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// peerMappingRows exports the entries of cfg, with hostnames from status
+// when it is known
+func peerMappingRows(cfg *Config, status *ipnstate.Status) []PeerMappingRow {
+	rows := []PeerMappingRow{}
+	for _, entry := range cfg.Peers {
+		row := PeerMappingRow{
+			StableID: entry.StableID,
+			NodeKey:  entry.NodeKey,
+			IP:       entry.IP,
+			Groups:   entry.Groups,
+			Policies: entry.Policies,
+			Tags:     entry.Tags,
+			Profiles: entry.Profiles,
+			Notes:    entry.Notes,
+		}
+		if status != nil {
+			id := entry.StableID
+			if id == "" {
+				id = entry.IP
+			}
+			if peer := findPeerStatus(status, id); peer != nil {
+				row.HostName = peer.HostName
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// matchImportRow finds the peer a row refers to, first in the netmap and then
+// among the configured peers. the hostname is only used for rows without
+// any other identity
+func matchImportRow(cfg *Config, status *ipnstate.Status, row PeerMappingRow) (TailscalePeer, bool) {
+	key := TailscalePeer{StableID: row.StableID, NodeKey: row.NodeKey, IP: row.IP}
+	byHostName := row.StableID == "" && row.NodeKey == "" && row.IP == "" && row.HostName != ""
+
+	if status != nil {
+		for _, peer := range status.Peer {
+			live := peerStatusToTailnetPeer(status, peer)
+			if key.Matches(live.StableID, live.NodeKey, live.IP) ||
+				(byHostName && strings.EqualFold(row.HostName, live.HostName)) {
+				return TailscalePeer{StableID: live.StableID, NodeKey: live.NodeKey, IP: live.IP}, true
+			}
+		}
+	}
+
+	for _, entry := range cfg.Peers {
+		if key.Matches(entry.StableID, entry.NodeKey, entry.IP) {
+			return TailscalePeer{StableID: entry.StableID, NodeKey: entry.NodeKey, IP: entry.IP}, true
+		}
+	}
+
+	return TailscalePeer{}, false
+}
+
+// importPeerRows returns cfg.Peers with the rows imported. mode=replace only
+// keeps the imported entries, and returns nil when a row is unmatched or
+// invalid since replacing with a partial list would drop the entries of
+// those rows
+func importPeerRows(cfg *Config, status *ipnstate.Status, rows []PeerMappingRow, mode string) ([]TailscalePeer, ImportReport) {
+	report := ImportReport{Mode: mode, Unmatched: []ImportRowError{}, Invalid: []ImportRowError{}}
+	imported := []TailscalePeer{}
+	for idx, row := range rows {
+		if row.StableID == "" && row.NodeKey == "" && row.IP == "" && row.HostName == "" {
+			report.Unmatched = append(report.Unmatched, ImportRowError{idx + 1, row, "needs a StableID, NodeKey, IP or HostName"})
+			continue
+		}
+
+		identity, ok := matchImportRow(cfg, status, row)
+		if !ok {
+			report.Unmatched = append(report.Unmatched, ImportRowError{idx + 1, row, "no known peer matches"})
+			continue
+		}
+
+		entry := identity
+		if existing := findPeerConfig(cfg, identity.StableID, identity.NodeKey, identity.IP); existing >= 0 && mode == "merge" {
+			//keep the fields the import leaves out
+			entry = cfg.Peers[existing]
+			entry.StableID = identity.StableID
+			entry.NodeKey = identity.NodeKey
+			entry.IP = identity.IP
+		}
+		entry.Groups = row.Groups
+		entry.Policies = row.Policies
+		entry.Notes = row.Notes
+		if row.Tags != nil || mode == "replace" {
+			entry.Tags = row.Tags
+		}
+		if row.Profiles != nil || mode == "replace" {
+			entry.Profiles = row.Profiles
+		}
+		if entry.Groups == nil {
+			entry.Groups = []string{}
+		}
+		if entry.Policies == nil {
+			entry.Policies = []string{}
+		}
+		if err := validatePeer(cfg, &entry); err != nil {
+			report.Invalid = append(report.Invalid, ImportRowError{idx + 1, row, err.Error()})
+			continue
+		}
+		imported = append(imported, entry)
+	}
+
+	peers := slices.Clone(cfg.Peers)
+	if mode == "replace" {
+		if len(report.Unmatched) > 0 || len(report.Invalid) > 0 {
+			return nil, report
+		}
+		peers = []TailscalePeer{}
+	}
+	for _, entry := range imported {
+		if idx := findPeerConfig(&Config{Peers: peers}, entry.StableID, entry.NodeKey, entry.IP); idx >= 0 {
+			peers[idx] = entry
+		} else {
+			peers = append(peers, entry)
+		}
+	}
+	report.Imported = len(imported)
+	return peers, report
+}
+
+func (tsp *tailscalePlugin) handleExportPeers(w http.ResponseWriter, r *http.Request) {
+	tsp.clientMtx.Lock()
+	status, err := tsp.cachedStatus(r.Context())
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		//hostnames are only for convenience, export without them
+		status = nil
+	}
+
+	Configmtx.RLock()
+	rows := peerMappingRows(&gConfig, status)
+	Configmtx.RUnlock()
+
+	if requestFormat(r) == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"tailscale-peers.csv\"")
+		if err := writePeerMappingCSV(w, rows); err != nil {
+			fmt.Println("Encoding peer export failed", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rows); err != nil {
+		httpInternalError("Encoding peer export failed", err, w)
+		return
+	}
+}
+
+// POST /peers/import?mode=merge (default) updates and adds the imported
+// peers, mode=replace drops every peer that is not in the import.
+func (tsp *tailscalePlugin) handleImportPeers(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, "mode must be merge or replace", 400)
+		return
+	}
+
+	rows := []PeerMappingRow{}
+	var err error
+	if requestFormat(r) == "csv" {
+		rows, err = readPeerMappingCSV(r.Body)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&rows)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	tsp.clientMtx.Lock()
+	status, err := tsp.cachedStatus(r.Context())
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		status = nil
+	}
+
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	peers, report := importPeerRows(&gConfig, status, rows, mode)
+	if peers == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	gConfig.Peers = peers
+
+	if err := writeConfigLocked(r.Context()); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	requestRebuild("api:peers/import")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		httpInternalError("Encoding import report failed", err, w)
+		return
+	}
+}
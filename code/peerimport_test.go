@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testPeersConfig() Config {
+	return Config{
+		Profiles: map[string]AccessProfile{"printing": {Groups: []string{"printers"}, Policies: []string{}}},
+		Peers: []TailscalePeer{
+			{StableID: "nlaptop", NodeKey: "abc", IP: "100.64.0.1", Groups: []string{"lab", "tailnet"}, Policies: []string{"wan"},
+				Tags: []string{"tag:dev"}, Profiles: []string{"printing"}, Notes: "Alice's laptop, \"work\"; second floor"},
+			{StableID: "nphone", NodeKey: "def", IP: "100.64.0.2", Groups: []string{}, Policies: []string{}},
+			//written before StableIDs were kept
+			{NodeKey: "ghi", IP: "fd7a:115c:a1e0::3", Groups: []string{"tailnet"}, Policies: []string{}},
+		},
+	}
+}
+
+func peersEqual(a TailscalePeer, b TailscalePeer) bool {
+	return a.StableID == b.StableID && a.NodeKey == b.NodeKey && a.IP == b.IP &&
+		slices.Equal(a.Groups, b.Groups) && slices.Equal(a.Policies, b.Policies) &&
+		slices.Equal(a.Tags, b.Tags) && slices.Equal(a.Profiles, b.Profiles) && a.Notes == b.Notes
+}
+
+func TestPeerMappingRoundTrip(t *testing.T) {
+	if err := registerValidators(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		format string
+		encode func(rows []PeerMappingRow) ([]byte, error)
+		decode func(data []byte) ([]PeerMappingRow, error)
+	}{
+		{
+			format: "json",
+			encode: func(rows []PeerMappingRow) ([]byte, error) { return json.Marshal(rows) },
+			decode: func(data []byte) ([]PeerMappingRow, error) {
+				rows := []PeerMappingRow{}
+				err := json.Unmarshal(data, &rows)
+				return rows, err
+			},
+		},
+		{
+			format: "csv",
+			encode: func(rows []PeerMappingRow) ([]byte, error) {
+				buf := bytes.Buffer{}
+				err := writePeerMappingCSV(&buf, rows)
+				return buf.Bytes(), err
+			},
+			decode: func(data []byte) ([]PeerMappingRow, error) { return readPeerMappingCSV(bytes.NewReader(data)) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			cfg := testPeersConfig()
+			data, err := tt.encode(peerMappingRows(&cfg, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := tt.decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peers, report := importPeerRows(&cfg, nil, rows, "replace")
+			if peers == nil {
+				t.Fatalf("replace import refused: %+v", report)
+			}
+			want := testPeersConfig().Peers
+			if len(peers) != len(want) {
+				t.Fatalf("got %d peers, want %d", len(peers), len(want))
+			}
+			for idx := range want {
+				if !peersEqual(peers[idx], want[idx]) {
+					t.Errorf("Peers[%d] = %+v, want %+v", idx, peers[idx], want[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestReadPeerMappingCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		want []PeerMappingRow
+		err  bool
+	}{
+		{
+			name: "empty",
+			csv:  "",
+			want: []PeerMappingRow{},
+		},
+		{
+			name: "columns in any order with spaces and empty list items",
+			csv:  "IP, Groups ,StableID\n100.64.0.1, lab; ;tailnet ,nlaptop\n",
+			want: []PeerMappingRow{{StableID: "nlaptop", IP: "100.64.0.1", Groups: []string{"lab", "tailnet"}, Policies: []string{}}},
+		},
+		{
+			name: "an empty Tags column clears, a missing Profiles column is nil",
+			csv:  "HostName,Tags\nlaptop,\n",
+			want: []PeerMappingRow{{HostName: "laptop", Groups: []string{}, Policies: []string{}, Tags: []string{}}},
+		},
+		{
+			name: "quoted notes keep commas and separators",
+			csv:  "StableID,Notes\nnlaptop,\"desk 4, \"\"blue\"\"; spare\"\n",
+			want: []PeerMappingRow{{StableID: "nlaptop", Groups: []string{}, Policies: []string{}, Notes: "desk 4, \"blue\"; spare"}},
+		},
+		{
+			name: "records with missing fields are rejected",
+			csv:  "StableID,IP,Groups\nnlaptop\n",
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readPeerMappingCSV(strings.NewReader(tt.csv))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("readPeerMappingCSV() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d", len(got), len(tt.want))
+			}
+			for idx := range tt.want {
+				g, w := got[idx], tt.want[idx]
+				if g.StableID != w.StableID || g.HostName != w.HostName || g.IP != w.IP || g.Notes != w.Notes ||
+					!slices.Equal(g.Groups, w.Groups) || !slices.Equal(g.Policies, w.Policies) ||
+					(g.Tags == nil) != (w.Tags == nil) || (g.Profiles == nil) != (w.Profiles == nil) {
+					t.Errorf("row %d = %+v, want %+v", idx, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestImportPeerRows(t *testing.T) {
+	if err := registerValidators(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		rows      []PeerMappingRow
+		mode      string
+		want      []string // StableID or IP, then groups, per resulting entry
+		unmatched int
+		invalid   int
+	}{
+		{
+			name: "merge updates by node key and keeps the rest",
+			rows: []PeerMappingRow{{NodeKey: "ghi", Groups: []string{"lab"}}},
+			mode: "merge",
+			want: []string{"nlaptop lab,tailnet", "nphone ", "fd7a:115c:a1e0::3 lab"},
+		},
+		{
+			name:      "rows without identity or match are reported",
+			rows:      []PeerMappingRow{{Groups: []string{"lab"}}, {StableID: "nunknown"}},
+			mode:      "merge",
+			want:      []string{"nlaptop lab,tailnet", "nphone ", "fd7a:115c:a1e0::3 tailnet"},
+			unmatched: 2,
+		},
+		{
+			name:    "unknown profiles are invalid",
+			rows:    []PeerMappingRow{{StableID: "nphone", Profiles: []string{"missing"}}},
+			mode:    "merge",
+			want:    []string{"nlaptop lab,tailnet", "nphone ", "fd7a:115c:a1e0::3 tailnet"},
+			invalid: 1,
+		},
+		{
+			name: "replace keeps only the imported entries",
+			rows: []PeerMappingRow{{IP: "100.64.0.2", Groups: []string{"lab"}}},
+			mode: "replace",
+			want: []string{"nphone lab"},
+		},
+		{
+			name:      "replace with an unmatched row changes nothing",
+			rows:      []PeerMappingRow{{IP: "100.64.0.2"}, {IP: "100.64.0.9"}},
+			mode:      "replace",
+			unmatched: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testPeersConfig()
+			peers, report := importPeerRows(&cfg, nil, tt.rows, tt.mode)
+			if len(report.Unmatched) != tt.unmatched || len(report.Invalid) != tt.invalid {
+				t.Errorf("report = %+v, want %d unmatched and %d invalid", report, tt.unmatched, tt.invalid)
+			}
+			if tt.want == nil {
+				if peers != nil {
+					t.Errorf("importPeerRows() = %+v, want nil", peers)
+				}
+				return
+			}
+			got := []string{}
+			for _, peer := range peers {
+				id := peer.StableID
+				if id == "" {
+					id = peer.IP
+				}
+				got = append(got, id+" "+strings.Join(peer.Groups, ","))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("importPeerRows() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
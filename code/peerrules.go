@@ -0,0 +1,191 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Peers without an explicit TailscalePeer entry get their SPR access from
+// rules in Config. Matches are additive: a peer gets the default groups and
+// policies plus the groups and policies of every rule it matches.
+
+// in DefaultGroups or DefaultPolicies, grants nothing (quarantine)
+const AccessNone = "none"
+
+// AccessProfile is a named bundle of groups and policies that peers and
+// rules can reference instead of repeating them
+type AccessProfile struct {
+	Groups   []string `validate:"groups"`
+	Policies []string `validate:"policies"`
+}
+
+// TagRule maps a tailscale ACL tag such as "tag:servers" to SPR access
+type TagRule struct {
+	Tag      string   `validate:"regexp=^tag:.+$"`
+	Groups   []string `validate:"groups"`
+	Policies []string `validate:"policies"`
+	Profiles []string `json:",omitempty"`
+}
+
+// UserRule maps the owner of a peer to SPR access. LoginName may be a glob,
+// e.g. "*@contractor.example", and is matched case-insensitively.
+type UserRule struct {
+	LoginName string   `validate:"nonzero"`
+	Groups    []string `validate:"groups"`
+	Policies  []string `validate:"policies"`
+	Profiles  []string `json:",omitempty"`
+}
+
+func (rule *UserRule) Matches(loginName string) bool {
+	if loginName == "" {
+		return false
+	}
+	return globMatch(rule.LoginName, loginName)
+}
+
+// HostRule matches peers by HostName or DNSName glob and OS. Empty fields
+// match anything. HostRules are ordered and only the first match applies.
+type HostRule struct {
+	Name     string   `json:",omitempty"` //label shown in /rules/test
+	HostName string   `json:",omitempty"` //e.g. "*-printer"
+	DNSName  string   `json:",omitempty"` //e.g. "*.tailnet-xyz.ts.net"
+	OS       string   `json:",omitempty"` //e.g. "android"
+	Groups   []string `validate:"groups"`
+	Policies []string `validate:"policies"`
+	Profiles []string `json:",omitempty"`
+}
+
+func globMatch(pattern string, value string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && ok
+}
+
+func (rule *HostRule) Matches(peer *tailnetPeer) bool {
+	if rule.HostName == "" && rule.DNSName == "" && rule.OS == "" {
+		return false
+	}
+	if rule.HostName != "" && !globMatch(rule.HostName, peer.HostName) {
+		return false
+	}
+	if rule.DNSName != "" && !globMatch(rule.DNSName, peer.DNSName) {
+		return false
+	}
+	if rule.OS != "" && !strings.EqualFold(rule.OS, peer.OS) {
+		return false
+	}
+	return true
+}
+
+func (rule *HostRule) label(idx int) string {
+	if rule.Name != "" {
+		return "host:" + rule.Name
+	}
+	return "host:#" + strconv.Itoa(idx)
+}
+
+// index of the first HostRule matching the peer, or -1
+func matchHostRule(cfg *Config, peer *tailnetPeer) int {
+	for idx := range cfg.HostRules {
+		if cfg.HostRules[idx].Matches(peer) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// the SPR access computed for one peer
+type peerAccess struct {
+	Groups   []string
+	Policies []string
+	// what the access came from, "peer", "tag:...", "user:...", "host:..." or "default"
+	Sources []string
+	// false when nothing in the config applies. an installed rule is then
+	// kept, unless it was installed from config that no longer applies
+	Managed bool
+}
+
+// the defaults from Config, falling back to gDefaultGroups. configured is
+// false when the site has not set any, in which case unmapped peers keep the
+// rule they were given by hand.
+func defaultAccess(cfg *Config) (groups []string, policies []string, configured bool) {
+	groups = gDefaultGroups
+	if len(cfg.DefaultGroups) > 0 {
+		groups = cfg.DefaultGroups
+		configured = true
+	}
+	if slices.Contains(groups, AccessNone) {
+		groups = []string{}
+	}
+
+	policies = []string{}
+	if len(cfg.DefaultPolicies) > 0 {
+		policies = cfg.DefaultPolicies
+		configured = true
+	}
+	if slices.Contains(policies, AccessNone) {
+		policies = []string{}
+	}
+
+	return groups, policies, configured
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// add grants groups and policies directly and through the named profiles.
+// unknown profiles grant nothing.
+func (a *peerAccess) add(cfg *Config, source string, groups []string, policies []string, profiles []string) {
+	a.Groups = appendUnique(a.Groups, groups...)
+	a.Policies = appendUnique(a.Policies, policies...)
+	for _, name := range profiles {
+		if profile, ok := cfg.Profiles[name]; ok {
+			a.Groups = appendUnique(a.Groups, profile.Groups...)
+			a.Policies = appendUnique(a.Policies, profile.Policies...)
+		}
+	}
+	a.Sources = append(a.Sources, source)
+	a.Managed = true
+}
+
+// resolvePeerAccess works out which SPR groups and policies a peer should have
+func resolvePeerAccess(cfg *Config, peer tailnetPeer) peerAccess {
+	access := peerAccess{Groups: []string{}, Policies: []string{}, Sources: []string{}}
+
+	if configured, ok := peerConfigFor(cfg, peer); ok {
+		access.add(cfg, "peer", configured.Groups, configured.Policies, configured.Profiles)
+		return access
+	}
+
+	for _, rule := range cfg.TagRules {
+		if slices.Contains(peer.Tags, rule.Tag) {
+			access.add(cfg, rule.Tag, rule.Groups, rule.Policies, rule.Profiles)
+		}
+	}
+
+	for _, rule := range cfg.UserRules {
+		if rule.Matches(peer.User) {
+			access.add(cfg, "user:"+rule.LoginName, rule.Groups, rule.Policies, rule.Profiles)
+		}
+	}
+
+	if idx := matchHostRule(cfg, &peer); idx >= 0 {
+		rule := cfg.HostRules[idx]
+		access.add(cfg, rule.label(idx), rule.Groups, rule.Policies, rule.Profiles)
+	}
+
+	groups, policies, configured := defaultAccess(cfg)
+	access.Groups = appendUnique(access.Groups, groups...)
+	access.Policies = appendUnique(access.Policies, policies...)
+	access.Sources = append(access.Sources, "default")
+	access.Managed = access.Managed || configured
+
+	return access
+}
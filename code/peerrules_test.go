@@ -0,0 +1,234 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolvePeerAccess(t *testing.T) {
+	laptop := tailnetPeer{StableID: "nlaptop", IP: "100.64.0.1", HostName: "laptop", DNSName: "laptop.tailnet-xyz.ts.net.", OS: "linux"}
+	tagged := func(tags ...string) tailnetPeer {
+		peer := laptop
+		peer.Tags = tags
+		return peer
+	}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		peer     tailnetPeer
+		groups   []string
+		policies []string
+		sources  []string
+		managed  bool
+	}{
+		{
+			name:     "unmapped peer gets the built-in default and is not managed",
+			peer:     laptop,
+			groups:   []string{"tailnet"},
+			policies: []string{},
+			sources:  []string{"default"},
+		},
+		{
+			name: "peer entry wins over rules",
+			cfg: Config{
+				Peers:    []TailscalePeer{{StableID: "nlaptop", Groups: []string{"lab"}, Policies: []string{"wan"}}},
+				TagRules: []TagRule{{Tag: "tag:servers", Groups: []string{"servers"}}},
+			},
+			peer:     tagged("tag:servers"),
+			groups:   []string{"lab"},
+			policies: []string{"wan"},
+			sources:  []string{"peer"},
+			managed:  true,
+		},
+		{
+			name: "tag rule adds to the defaults",
+			cfg: Config{
+				TagRules: []TagRule{{Tag: "tag:servers", Groups: []string{"servers"}, Policies: []string{"wan"}}},
+			},
+			peer:     tagged("tag:servers"),
+			groups:   []string{"servers", "tailnet"},
+			policies: []string{"wan"},
+			sources:  []string{"tag:servers", "default"},
+			managed:  true,
+		},
+		{
+			name: "every matching tag rule applies, without duplicates",
+			cfg: Config{
+				TagRules: []TagRule{
+					{Tag: "tag:servers", Groups: []string{"servers", "lab"}},
+					{Tag: "tag:lab", Groups: []string{"lab"}},
+					{Tag: "tag:other", Groups: []string{"other"}},
+				},
+			},
+			peer:     tagged("tag:lab", "tag:servers"),
+			groups:   []string{"servers", "lab", "tailnet"},
+			policies: []string{},
+			sources:  []string{"tag:servers", "tag:lab", "default"},
+			managed:  true,
+		},
+		{
+			name: "tag rule that does not match leaves the peer unmanaged",
+			cfg: Config{
+				TagRules: []TagRule{{Tag: "tag:servers", Groups: []string{"servers"}}},
+			},
+			peer:     tagged("tag:laptops"),
+			groups:   []string{"tailnet"},
+			policies: []string{},
+			sources:  []string{"default"},
+		},
+		{
+			name: "user rule globs match case-insensitively",
+			cfg: Config{
+				UserRules: []UserRule{{LoginName: "*@Contractor.example", Groups: []string{"guests"}, Policies: []string{"wan"}}},
+			},
+			peer:     tailnetPeer{StableID: "nlaptop", User: "bob@contractor.example"},
+			groups:   []string{"guests", "tailnet"},
+			policies: []string{"wan"},
+			sources:  []string{"user:*@Contractor.example", "default"},
+			managed:  true,
+		},
+		{
+			name: "user rules never match peers without an owner",
+			cfg: Config{
+				UserRules: []UserRule{{LoginName: "*", Groups: []string{"guests"}}},
+			},
+			peer:     tagged("tag:servers"),
+			groups:   []string{"tailnet"},
+			policies: []string{},
+			sources:  []string{"default"},
+		},
+		{
+			name: "tag and user rules both apply, tags first",
+			cfg: Config{
+				TagRules:  []TagRule{{Tag: "tag:servers", Groups: []string{"servers"}}},
+				UserRules: []UserRule{{LoginName: "alice@example.com", Groups: []string{"admins"}}},
+			},
+			peer:     tailnetPeer{StableID: "nlaptop", User: "alice@example.com", Tags: []string{"tag:servers"}},
+			groups:   []string{"servers", "admins", "tailnet"},
+			policies: []string{},
+			sources:  []string{"tag:servers", "user:alice@example.com", "default"},
+			managed:  true,
+		},
+		{
+			name:     "configured defaults replace the built-in one and manage the peer",
+			cfg:      Config{DefaultGroups: []string{"guests"}, DefaultPolicies: []string{"dns"}},
+			peer:     laptop,
+			groups:   []string{"guests"},
+			policies: []string{"dns"},
+			sources:  []string{"default"},
+			managed:  true,
+		},
+		{
+			name:     "none quarantines unmapped peers",
+			cfg:      Config{DefaultGroups: []string{AccessNone}, DefaultPolicies: []string{AccessNone}},
+			peer:     laptop,
+			groups:   []string{},
+			policies: []string{},
+			sources:  []string{"default"},
+			managed:  true,
+		},
+		{
+			name: "rules still grant access when the defaults are none",
+			cfg: Config{
+				DefaultGroups: []string{AccessNone},
+				TagRules:      []TagRule{{Tag: "tag:servers", Groups: []string{"servers"}}},
+			},
+			peer:     tagged("tag:servers"),
+			groups:   []string{"servers"},
+			policies: []string{},
+			sources:  []string{"tag:servers", "default"},
+			managed:  true,
+		},
+		{
+			name: "only the first matching host rule applies",
+			cfg: Config{
+				HostRules: []HostRule{
+					{Name: "printers", HostName: "*-printer", Groups: []string{"printers"}},
+					{HostName: "LAP*", OS: "Linux", Groups: []string{"lab"}},
+					{DNSName: "*.tailnet-xyz.ts.net.", Groups: []string{"everyone"}},
+				},
+			},
+			peer:     laptop,
+			groups:   []string{"lab", "tailnet"},
+			policies: []string{},
+			sources:  []string{"host:#1", "default"},
+			managed:  true,
+		},
+		{
+			name: "host rule needs every field it sets to match",
+			cfg: Config{
+				HostRules: []HostRule{{Name: "android laptops", HostName: "laptop", OS: "android", Groups: []string{"lab"}}},
+			},
+			peer:     laptop,
+			groups:   []string{"tailnet"},
+			policies: []string{},
+			sources:  []string{"default"},
+		},
+		{
+			name: "host rule without patterns matches nothing",
+			cfg: Config{
+				HostRules: []HostRule{{Name: "empty", Groups: []string{"lab"}}},
+			},
+			peer:     laptop,
+			groups:   []string{"tailnet"},
+			policies: []string{},
+			sources:  []string{"default"},
+		},
+		{
+			name: "tag, user and host rules add up in that order",
+			cfg: Config{
+				TagRules:  []TagRule{{Tag: "tag:servers", Groups: []string{"servers"}}},
+				UserRules: []UserRule{{LoginName: "alice@example.com", Groups: []string{"admins"}}},
+				HostRules: []HostRule{{Name: "laptops", HostName: "laptop", Groups: []string{"lab"}, Policies: []string{"wan"}}},
+			},
+			peer:     tailnetPeer{StableID: "nlaptop", HostName: "laptop", User: "alice@example.com", Tags: []string{"tag:servers"}},
+			groups:   []string{"servers", "admins", "lab", "tailnet"},
+			policies: []string{"wan"},
+			sources:  []string{"tag:servers", "user:alice@example.com", "host:laptops", "default"},
+			managed:  true,
+		},
+		{
+			name: "peer entry profiles add to its own groups",
+			cfg: Config{
+				Profiles: map[string]AccessProfile{"printing": {Groups: []string{"printers"}, Policies: []string{"lan"}}},
+				Peers:    []TailscalePeer{{StableID: "nlaptop", Groups: []string{"lab"}, Policies: []string{}, Profiles: []string{"printing"}}},
+			},
+			peer:     laptop,
+			groups:   []string{"lab", "printers"},
+			policies: []string{"lan"},
+			sources:  []string{"peer"},
+			managed:  true,
+		},
+		{
+			name: "rule profiles are expanded, unknown ones grant nothing",
+			cfg: Config{
+				Profiles: map[string]AccessProfile{"servers": {Groups: []string{"servers", "tailnet"}, Policies: []string{"wan"}}},
+				TagRules: []TagRule{{Tag: "tag:servers", Profiles: []string{"servers", "missing"}}},
+			},
+			peer:     tagged("tag:servers"),
+			groups:   []string{"servers", "tailnet"},
+			policies: []string{"wan"},
+			sources:  []string{"tag:servers", "default"},
+			managed:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := resolvePeerAccess(&tt.cfg, tt.peer)
+			if !slices.Equal(access.Groups, tt.groups) {
+				t.Errorf("Groups = %q, want %q", access.Groups, tt.groups)
+			}
+			if !slices.Equal(access.Policies, tt.policies) {
+				t.Errorf("Policies = %q, want %q", access.Policies, tt.policies)
+			}
+			if !slices.Equal(access.Sources, tt.sources) {
+				t.Errorf("Sources = %q, want %q", access.Sources, tt.sources)
+			}
+			if access.Managed != tt.managed {
+				t.Errorf("Managed = %v, want %v", access.Managed, tt.managed)
+			}
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"tailscale.com/client/tailscale"
+)
+
+// reconciliation is split in two: computePlan diffs the desired state against
+// what SPR and tailscaled currently have without touching either, applyPlan
+// then performs the resulting actions. GET /plan exposes the first half.
+
+// a tailnet peer as seen by the reconciler
+type tailnetPeer struct {
+	StableID string
+	NodeKey  string
+	IP       string   //primary address, IPv4 when the peer has one
+	IPs      []string //every tailscale address, IP first
+	// subnets this peer routes for the tailnet
+	PrimaryRoutes []string
+	Tags          []string
+	User          string //login name of the owner
+	HostName      string
+	DNSName       string
+	OS            string
+}
+
+// everything computePlan needs, gathered up front so planning has no side effects
+type reconcileState struct {
+	Config   Config
+	Firewall FirewallConfig
+	Devices  map[string]DeviceEntry
+	// SPR LAN subnets, only fetched when a group is advertised as the supernet
+	// or routes are imported. nil when they could not be fetched
+	LANSubnets  []string
+	Peers       []tailnetPeer
+	ContainerIP string
+	// the container's eth0 networks, imports must not overlap them either
+	ContainerNetworks []string
+	// route destination for IPv6 peer addresses, empty without IPv6
+	ContainerIPv6 string
+
+	// what tailscaled currently advertises, or what we last advertised when
+	// the prefs cannot be read. PrefsKnown is false when neither is known,
+	// in which case routes are always re-advertised.
+	PrefsKnown          bool
+	AdvertisedRoutes    []string
+	AdvertisingExitNode bool
+	AcceptingRoutes     bool
+
+	// what the exit node ip rules currently route, see exitnode.go.
+	// ExitRoutingKnown is false until the first pass has flushed them.
+	ExitRoutingKnown   bool
+	ExitRoutingEnabled bool
+	ExitSources        []string
+}
+
+const (
+	PlanDelete    = "delete"
+	PlanAdd       = "add"
+	PlanAdvertise = "advertise"
+	// route the exit node group's devices (Routes) through the exit node
+	PlanExitRoute = "exitroute"
+	// stop routing anything through the exit node
+	PlanExitRouteClear = "exitroute-clear"
+	// turn accepting routes from the tailnet on or off (AcceptRoutes)
+	PlanAcceptRoutes = "accept-routes"
+)
+
+// a single change to SPR or tailscaled, in the order it will be applied
+type PlanAction struct {
+	Action string
+	Reason string
+	Rule   *CustomInterfaceRule `json:",omitempty"`
+	Routes []string             `json:",omitempty"`
+	// for PlanAcceptRoutes, and passed along when advertising
+	AcceptRoutes bool `json:",omitempty"`
+}
+
+type Plan struct {
+	// when set, rebuildState will not apply this plan
+	Down   bool `json:",omitempty"`
+	Routes []string
+	// whether tailscaled should accept routes, and why not while imports
+	// are configured
+	AcceptRoutes        bool
+	AcceptRoutesBlocked string `json:",omitempty"`
+	Actions             []PlanAction
+}
+
+func (s *reconcileState) peerIPs() []string {
+	ips := []string{}
+	for _, peer := range s.Peers {
+		ips = append(ips, peer.IPs...)
+	}
+	return ips
+}
+
+// skip addresses tailscale does not hand out, we're looking for peers
+func isTailnetIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range tailnetPrefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func collectPeers(client *tailscale.LocalClient) ([]tailnetPeer, error) {
+	tsdStatus, err := client.Status(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []tailnetPeer{}
+	for _, peer := range tsdStatus.Peer {
+		if len(peer.TailscaleIPs) > 0 {
+			peers = append(peers, peerStatusToTailnetPeer(tsdStatus, peer))
+		}
+	}
+
+	slices.SortFunc(peers, func(a, b tailnetPeer) int { return strings.Compare(a.IP, b.IP) })
+	return peers, nil
+}
+
+func gatherReconcileState() (*reconcileState, error) {
+	state := &reconcileState{}
+
+	Configmtx.RLock()
+	state.Config = gConfig
+	state.Config.Peers = slices.Clone(gConfig.Peers)
+	Configmtx.RUnlock()
+
+	fw, err := getSPRFirewallConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fw config: %w", err)
+	}
+	state.Firewall = fw
+
+	client := tailscale.LocalClient{
+		Socket:        UNIX_TAILSCALE_SOCK,
+		UseSocketOnly: true,
+	}
+
+	// an empty peer list would delete every rule, so bail out instead
+	state.Peers, err = collectPeers(&client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tailscale status: %w", err)
+	}
+
+	state.ContainerIP = getContainerIP()
+	state.ContainerIPv6 = getContainerIPv6()
+	state.ExitRoutingKnown, state.ExitRoutingEnabled, state.ExitSources = gExitRouting.get()
+
+	state.Devices, err = APIDevices()
+	if err != nil {
+		fmt.Println("[-] Failed to load SPR devices, not advertising routes", err)
+		state.Devices = nil
+	}
+
+	if state.Config.needsLANSubnets() || state.Config.acceptRoutes() {
+		state.LANSubnets, err = getSPRSubnets()
+		if err != nil {
+			fmt.Println("[-] Failed to load SPR subnets, not updating advertised or imported routes", err)
+			state.LANSubnets = nil
+			if state.Config.needsLANSubnets() {
+				state.Devices = nil
+			}
+		} else if state.LANSubnets == nil {
+			state.LANSubnets = []string{}
+		}
+	}
+	state.ContainerNetworks = getContainerNetworks()
+
+	prefs, err := client.GetPrefs(context.Background())
+	if err == nil {
+		state.PrefsKnown = true
+		state.AcceptingRoutes = prefs.RouteAll
+		state.AdvertisedRoutes = []string{}
+		for _, prefix := range prefs.AdvertiseRoutes {
+			if prefix.Bits() == 0 {
+				// 0.0.0.0/0 and ::/0 mean we are an exit node
+				state.AdvertisingExitNode = true
+				continue
+			}
+			state.AdvertisedRoutes = append(state.AdvertisedRoutes, prefix.String())
+		}
+		state.AdvertisedRoutes = sortRoutes(state.AdvertisedRoutes)
+	} else {
+		//fall back to what we last sent
+		state.PrefsKnown, state.AdvertisedRoutes, state.AdvertisingExitNode, state.AcceptingRoutes = gAdvertised.get()
+	}
+
+	return state, nil
+}
+
+// look up the configured groups and policies for a peer
+func peerConfigFor(cfg *Config, peer tailnetPeer) (TailscalePeer, bool) {
+	for _, entry := range cfg.Peers {
+		if entry.Matches(peer.StableID, peer.NodeKey, peer.IP) {
+			return entry, true
+		}
+	}
+	return TailscalePeer{}, false
+}
+
+// refreshPeerIdentities brings the derived IP and node key of each configured
+// peer up to date with the netmap, and backfills the StableID of entries
+// written before it existed. returns true if gConfig was rewritten.
+func refreshPeerIdentities(peers []tailnetPeer) bool {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	changed := false
+	for idx := range gConfig.Peers {
+		entry := &gConfig.Peers[idx]
+		for _, peer := range peers {
+			if !entry.Matches(peer.StableID, peer.NodeKey, peer.IP) {
+				continue
+			}
+			if entry.StableID != peer.StableID || entry.NodeKey != peer.NodeKey || entry.IP != peer.IP {
+				entry.StableID = peer.StableID
+				entry.NodeKey = peer.NodeKey
+				entry.IP = peer.IP
+				changed = true
+			}
+			break
+		}
+	}
+
+	if changed {
+		if err := writeConfigLocked(context.Background()); err != nil {
+			fmt.Println("[-] Failed to save refreshed peers", err)
+		}
+	}
+	return changed
+}
+
+func newPeerRule(ip string, policies []string, groups []string, routeDst string) CustomInterfaceRule {
+	return CustomInterfaceRule{
+		BaseRule:  BaseRule{RuleName: GeneratedRulePrefix + ip},
+		Interface: gSPRTailscaleInterface,
+		SrcIP:     ip,
+		RouteDst:  routeDst,
+		Policies:  policies,
+		Groups:    groups,
+		Tags:      []string{},
+	}
+}
+
+// newManagedPeerRule is a peer rule whose access came from a Peers entry, a
+// rule or the configured defaults, see isManagedRule
+func newManagedPeerRule(ip string, policies []string, groups []string, routeDst string) CustomInterfaceRule {
+	rule := newPeerRule(ip, policies, groups, routeDst)
+	rule.RuleName = ManagedRulePrefix + ip
+	return rule
+}
+
+func sameStrings(a []string, b []string) bool {
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// whether an installed rule already grants what we want. tags and the rest of
+// the name are ignored, SPR may have been given the rule by an older version
+// of the plugin
+func ruleSatisfies(have *CustomInterfaceRule, want *CustomInterfaceRule) bool {
+	return have.RouteDst == want.RouteDst &&
+		isManagedRule(have) == isManagedRule(want) &&
+		sameStrings(have.Groups, want.Groups) &&
+		sameStrings(have.Policies, want.Policies)
+}
+
+// computePlan works out which rules and routes need to change. it only reads state.
+func computePlan(state *reconcileState) Plan {
+	plan := Plan{Down: state.Config.AdministrativelyDown, Actions: []PlanAction{}}
+
+	deleteRule := func(rule CustomInterfaceRule, reason string) {
+		plan.Actions = append(plan.Actions, PlanAction{Action: PlanDelete, Reason: reason, Rule: &rule})
+	}
+	addRule := func(rule CustomInterfaceRule, reason string) {
+		plan.Actions = append(plan.Actions, PlanAction{Action: PlanAdd, Reason: reason, Rule: &rule})
+	}
+
+	peerIPs := state.peerIPs()
+
+	// the rule set as it will be once the plan is applied, for route computation
+	finalRules := []CustomInterfaceRule{}
+
+	//first remove any peers that dont belong
+	installed := map[string]CustomInterfaceRule{}
+	importInstalled := map[string]CustomInterfaceRule{}
+	for _, entry := range state.Firewall.CustomInterfaceRules {
+		if isImportedRouteRule(&entry) {
+			if _, exists := importInstalled[entry.SrcIP]; exists {
+				deleteRule(entry, "duplicate rule for "+entry.SrcIP)
+				continue
+			}
+			importInstalled[entry.SrcIP] = entry
+			continue
+		}
+
+		if entry.Interface != gSPRTailscaleInterface || !isTailnetIP(entry.SrcIP) {
+			finalRules = append(finalRules, entry)
+			continue
+		}
+
+		if !slices.Contains(peerIPs, entry.SrcIP) {
+			deleteRule(entry, "peer "+entry.SrcIP+" is no longer on the tailnet")
+			continue
+		}
+
+		if _, exists := installed[entry.SrcIP]; exists {
+			deleteRule(entry, "duplicate rule for "+entry.SrcIP)
+			continue
+		}
+		installed[entry.SrcIP] = entry
+	}
+
+	//then install the new ones, a rule for each address of a peer
+	for _, peer := range state.Peers {
+		access := resolvePeerAccess(&state.Config, peer)
+
+		for _, ip := range peer.IPs {
+			routeDst := state.ContainerIP
+			if strings.Contains(ip, ":") {
+				if state.ContainerIPv6 == "" {
+					//SPR could not route replies back to us
+					continue
+				}
+				routeDst = state.ContainerIPv6
+			}
+
+			existing, isInstalled := installed[ip]
+
+			var want CustomInterfaceRule
+			if access.Managed {
+				want = newManagedPeerRule(ip, access.Policies, access.Groups, routeDst)
+			} else if isInstalled && !isManagedRule(&existing) {
+				// unconfigured peers keep whatever access they were given by hand
+				want = newPeerRule(ip, existing.Policies, existing.Groups, routeDst)
+			} else {
+				// new peers, and peers that no entry or rule applies to any
+				// more, get the default access
+				want = newPeerRule(ip, access.Policies, access.Groups, routeDst)
+			}
+
+			if isInstalled {
+				if ruleSatisfies(&existing, &want) {
+					//peer already established with correct groups and policies
+					finalRules = append(finalRules, existing)
+					continue
+				}
+
+				reason := "groups or policies changed for " + ip + " (" + strings.Join(access.Sources, ", ") + ")"
+				if existing.RouteDst != want.RouteDst {
+					reason = "route for " + ip + " moved to " + want.RouteDst
+				}
+				deleteRule(existing, reason)
+				addRule(want, reason)
+			} else {
+				addRule(want, "new peer "+ip)
+			}
+			finalRules = append(finalRules, want)
+		}
+	}
+
+	//subnets of other tailnet routers, for the groups importing them
+	imported := []string{}
+	importedRoutes := []importedRoute{}
+	if state.Config.acceptRoutes() && state.LANSubnets == nil {
+		//conflicts with SPR's subnets cannot be checked, keep what is there
+		plan.AcceptRoutes = state.AcceptingRoutes
+		plan.AcceptRoutesBlocked = "SPR subnets unknown"
+		for prefix, existing := range importInstalled {
+			imported = append(imported, prefix)
+			finalRules = append(finalRules, existing)
+		}
+	} else {
+		plan.AcceptRoutes, plan.AcceptRoutesBlocked = acceptRoutesDecision(&state.Config, state.Peers, state.LANSubnets, state.ContainerNetworks)
+		if plan.AcceptRoutes {
+			importedRoutes = computeImportedRoutes(&state.Config, state.Peers, state.LANSubnets, state.ContainerNetworks)
+		}
+	}
+	if !state.PrefsKnown || state.AcceptingRoutes != plan.AcceptRoutes {
+		reason := "route imports changed"
+		if plan.AcceptRoutesBlocked != "" {
+			reason = "blocked: " + plan.AcceptRoutesBlocked
+		}
+		plan.Actions = append(plan.Actions, PlanAction{Action: PlanAcceptRoutes, Reason: reason, AcceptRoutes: plan.AcceptRoutes})
+	}
+	for _, route := range importedRoutes {
+		routeDst := state.ContainerIP
+		if strings.Contains(route.Prefix, ":") {
+			if state.ContainerIPv6 == "" {
+				continue
+			}
+			routeDst = state.ContainerIPv6
+		}
+		imported = append(imported, route.Prefix)
+
+		want := newPeerRule(route.Prefix, []string{}, route.Groups, routeDst)
+		reason := "import " + route.Prefix + " from " + strings.Join(route.Routers, ", ") + " for " + strings.Join(route.Groups, ", ")
+		if existing, isInstalled := importInstalled[route.Prefix]; isInstalled {
+			if ruleSatisfies(&existing, &want) {
+				finalRules = append(finalRules, existing)
+				continue
+			}
+			deleteRule(existing, reason)
+		}
+		addRule(want, reason)
+		finalRules = append(finalRules, want)
+	}
+	for prefix, existing := range importInstalled {
+		if !slices.Contains(imported, prefix) {
+			deleteRule(existing, "route "+prefix+" is no longer imported")
+		}
+	}
+
+	//devices in the exit node group are routed through the selected exit node
+	if state.Config.ExitNode.StableID == "" {
+		if !state.ExitRoutingKnown || state.ExitRoutingEnabled {
+			plan.Actions = append(plan.Actions, PlanAction{Action: PlanExitRouteClear, Reason: "no exit node selected"})
+		}
+	} else if state.Devices != nil {
+		sources := computeExitSources(state.Config.ExitNode.group(), state.Devices)
+		if !state.ExitRoutingEnabled || !slices.Equal(sources, state.ExitSources) {
+			plan.Actions = append(plan.Actions, PlanAction{Action: PlanExitRoute, Reason: "exit node group " + state.Config.ExitNode.group() + " changed", Routes: sources})
+		}
+	}
+
+	//second half, get routes for tailscale and advertise them.
+	if state.Devices == nil {
+		return plan
+	}
+
+	plan.Routes = computeSPRRoutes(&state.Config, finalRules, state.Devices, state.LANSubnets)
+	advertise := func(reason string) {
+		plan.Actions = append(plan.Actions, PlanAction{Action: PlanAdvertise, Reason: reason, Routes: plan.Routes, AcceptRoutes: plan.AcceptRoutes})
+	}
+	if !state.PrefsKnown {
+		advertise("current routes unknown")
+	} else if !slices.Equal(plan.Routes, state.AdvertisedRoutes) {
+		advertise("advertised routes changed")
+	} else if state.AdvertisingExitNode != state.Config.AdvertiseExitNode {
+		advertise("exit node setting changed")
+	}
+
+	return plan
+}
+
+// gApplyMtx is held while a plan action runs. PUT /down takes it too, so it
+// cannot interleave with an action, and every action re-checks the down state
+var gApplyMtx sync.Mutex
+
+func administrativelyDown() bool {
+	Configmtx.RLock()
+	defer Configmtx.RUnlock()
+	return gConfig.AdministrativelyDown
+}
+
+// applyPlan performs the actions in order and returns any failures. it stops
+// early when the plugin is taken down meanwhile
+func applyPlan(plan Plan) []error {
+	errs := []error{}
+	failedDeletes := []string{}
+
+	for _, action := range plan.Actions {
+		gApplyMtx.Lock()
+		if administrativelyDown() {
+			//PUT /down came in during the pass, do not undo it
+			gApplyMtx.Unlock()
+			fmt.Println("[-] Administratively down, stopping rebuild")
+			break
+		}
+		errs = append(errs, applyAction(action, &failedDeletes)...)
+		gApplyMtx.Unlock()
+	}
+
+	return errs
+}
+
+func applyAction(action PlanAction, failedDeletes *[]string) []error {
+	errs := []error{}
+	switch action.Action {
+	case PlanDelete:
+		rule := action.Rule
+		err := updateCustomInterface(true, *rule)
+		if err != nil {
+			*failedDeletes = append(*failedDeletes, rule.SrcIP)
+			errs = append(errs, fmt.Errorf("failed to delete peer %s: %w", rule.SrcIP, err))
+		}
+	case PlanAdd:
+		rule := action.Rule
+		if slices.Contains(*failedDeletes, rule.SrcIP) {
+			// the old rule is still there, do not stack another one on top
+			break
+		}
+		err := updateCustomInterface(false, *rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to install peer %s: %w", rule.SrcIP, err))
+		}
+	case PlanExitRoute, PlanExitRouteClear:
+		if err := applyExitRouting(action.Action == PlanExitRoute, action.Routes); err != nil {
+			errs = append(errs, err)
+		}
+	case PlanAcceptRoutes:
+		if err := setAcceptRoutes(action.AcceptRoutes); err != nil {
+			errs = append(errs, fmt.Errorf("failed to change accepting routes: %w", err))
+		}
+	case PlanAdvertise:
+		if err := advertiseRoutes(action.Routes, action.AcceptRoutes); err != nil {
+			errs = append(errs, fmt.Errorf("failed to advertise routes to tailscale: %w", err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testContainerIP = "192.168.2.50"
+
+func testPeer(hostname string, ips ...string) tailnetPeer {
+	return tailnetPeer{StableID: "n" + hostname, IP: ips[0], IPs: ips, HostName: hostname}
+}
+
+// one line per action, e.g. "add 100.64.0.1 tailnet", in plan order. rules
+// with config derived access are marked "(managed)"
+func describePlan(plan Plan) []string {
+	lines := []string{}
+	for _, action := range plan.Actions {
+		line := action.Action
+		if action.Rule != nil {
+			line += " " + action.Rule.SrcIP + " " + strings.Join(action.Rule.Groups, ",")
+			if action.Rule.RouteDst != testContainerIP {
+				line += " via " + action.Rule.RouteDst
+			}
+			if isManagedRule(action.Rule) {
+				line += " (managed)"
+			}
+		} else if action.Action == PlanAcceptRoutes {
+			line += " " + strconv.FormatBool(action.AcceptRoutes)
+		} else if len(action.Routes) > 0 {
+			line += " " + strings.Join(action.Routes, ",")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestComputePlan(t *testing.T) {
+	tests := []struct {
+		name  string
+		state reconcileState
+		// tailscaled's prefs could not be read
+		prefsUnknown bool
+		// the exit node ip rules have not been flushed yet
+		firstPass bool
+		want      []string
+	}{
+		{
+			name: "new peer gets the default group",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+			},
+			want: []string{"add 100.64.0.1 tailnet"},
+		},
+		{
+			name: "installed peer is left alone",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+				}},
+			},
+			want: []string{},
+		},
+		{
+			name: "peer that left the tailnet is removed",
+			state: reconcileState{
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 100.64.0.1 tailnet"},
+		},
+		{
+			name: "duplicate rules are removed",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 100.64.0.1 tailnet"},
+		},
+		{
+			name: "configured groups replace the installed rule",
+			state: reconcileState{
+				Config: Config{Peers: []TailscalePeer{{StableID: "nlaptop", IP: "100.64.0.1", Groups: []string{"lab"}, Policies: []string{}}}},
+				Peers:  []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 100.64.0.1 tailnet", "add 100.64.0.1 lab (managed)"},
+		},
+		{
+			name: "tag rule adds its groups to the defaults",
+			state: reconcileState{
+				Config: Config{TagRules: []TagRule{{Tag: "tag:lab", Groups: []string{"lab"}, Policies: []string{}}}},
+				Peers:  []tailnetPeer{{StableID: "nlaptop", IP: "100.64.0.1", IPs: []string{"100.64.0.1"}, Tags: []string{"tag:lab"}}},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 100.64.0.1 tailnet", "add 100.64.0.1 lab,tailnet (managed)"},
+		},
+		{
+			name: "peer whose tag was removed loses the tag rule's groups",
+			state: reconcileState{
+				Config: Config{TagRules: []TagRule{{Tag: "tag:lab", Groups: []string{"lab"}, Policies: []string{}}}},
+				Peers:  []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newManagedPeerRule("100.64.0.1", []string{}, []string{"lab", "tailnet"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 100.64.0.1 lab,tailnet (managed)", "add 100.64.0.1 tailnet"},
+		},
+		{
+			name: "peer whose entry was deleted falls back to the defaults",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newManagedPeerRule("100.64.0.1", []string{"wan"}, []string{"lab"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 100.64.0.1 lab (managed)", "add 100.64.0.1 tailnet"},
+		},
+		{
+			name: "access given by hand is kept",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{"wan"}, []string{"lab"}, testContainerIP),
+				}},
+			},
+			want: []string{},
+		},
+		{
+			name: "rules of other interfaces are not touched",
+			state: reconcileState{
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					{Interface: "wg0", SrcIP: "100.64.0.9", Groups: []string{"tailnet"}},
+				}},
+			},
+			want: []string{},
+		},
+		{
+			name: "IPv6 address is skipped without a container IPv6 address",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1", "fd7a:115c:a1e0::1")},
+			},
+			want: []string{"add 100.64.0.1 tailnet"},
+		},
+		{
+			name: "IPv6 address is routed via the container IPv6 address",
+			state: reconcileState{
+				Peers:         []tailnetPeer{testPeer("laptop", "100.64.0.1", "fd7a:115c:a1e0::1")},
+				ContainerIPv6: "2001:db8::50",
+			},
+			want: []string{"add 100.64.0.1 tailnet", "add fd7a:115c:a1e0::1 tailnet via 2001:db8::50"},
+		},
+		{
+			name: "devices of granted groups are advertised",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Devices: map[string]DeviceEntry{
+					"nas":     {RecentIP: "192.168.2.6", Groups: []string{"tailnet"}},
+					"printer": {RecentIP: "192.168.2.10", Groups: []string{"lan"}},
+				},
+			},
+			want: []string{"add 100.64.0.1 tailnet", "advertise 192.168.2.4/30"},
+		},
+		{
+			name: "unchanged routes are not advertised again",
+			state: reconcileState{
+				Peers: []tailnetPeer{testPeer("laptop", "100.64.0.1")},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.1", []string{}, []string{"tailnet"}, testContainerIP),
+				}},
+				Devices:          map[string]DeviceEntry{"nas": {RecentIP: "192.168.2.6", Groups: []string{"tailnet"}}},
+				AdvertisedRoutes: []string{"192.168.2.4/30"},
+			},
+			want: []string{},
+		},
+		{
+			name: "routes are advertised when the current ones are unknown",
+			state: reconcileState{
+				Devices: map[string]DeviceEntry{},
+			},
+			prefsUnknown: true,
+			want:         []string{"accept-routes false", "advertise"},
+		},
+		{
+			name: "imported route gets a rule for the importing group",
+			state: reconcileState{
+				Config:     Config{RouteImports: map[string][]string{"lab": {"10.0.0.0/8"}}},
+				Peers:      []tailnetPeer{{StableID: "nrouter", IP: "100.64.0.2", IPs: []string{"100.64.0.2"}, HostName: "router", PrimaryRoutes: []string{"10.9.0.0/16"}}},
+				LANSubnets: []string{"192.168.2.0/24"},
+			},
+			want: []string{"add 100.64.0.2 tailnet", "accept-routes true", "add 10.9.0.0/16 lab"},
+		},
+		{
+			name: "routes are not accepted while one overlaps an SPR subnet",
+			state: reconcileState{
+				Config:     Config{RouteImports: map[string][]string{"lab": {"10.0.0.0/8"}}},
+				Peers:      []tailnetPeer{{StableID: "nrouter", IP: "100.64.0.2", IPs: []string{"100.64.0.2"}, HostName: "router", PrimaryRoutes: []string{"10.9.0.0/16"}}},
+				LANSubnets: []string{"10.9.8.0/24"},
+			},
+			want: []string{"add 100.64.0.2 tailnet"},
+		},
+		{
+			name: "overlapping route of another router stops accepting and importing",
+			state: reconcileState{
+				Config: Config{RouteImports: map[string][]string{"lab": {"10.0.0.0/8"}}},
+				Peers: []tailnetPeer{
+					{StableID: "nrouter", IP: "100.64.0.2", IPs: []string{"100.64.0.2"}, HostName: "router", PrimaryRoutes: []string{"10.9.0.0/16"}},
+					{StableID: "nrogue", IP: "100.64.0.3", IPs: []string{"100.64.0.3"}, HostName: "rogue", PrimaryRoutes: []string{"192.168.2.0/25"}},
+				},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("100.64.0.2", []string{}, []string{"tailnet"}, testContainerIP),
+					newPeerRule("100.64.0.3", []string{}, []string{"tailnet"}, testContainerIP),
+					newPeerRule("10.9.0.0/16", []string{}, []string{"lab"}, testContainerIP),
+				}},
+				LANSubnets:      []string{"192.168.2.0/24"},
+				AcceptingRoutes: true,
+			},
+			want: []string{"accept-routes false", "delete 10.9.0.0/16 lab"},
+		},
+		{
+			name: "imported routes are kept while SPR subnets are unknown",
+			state: reconcileState{
+				Config: Config{RouteImports: map[string][]string{"lab": {"10.0.0.0/8"}}},
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("10.7.0.0/16", []string{}, []string{"lab"}, testContainerIP),
+				}},
+			},
+			want: []string{},
+		},
+		{
+			name: "route no longer imported is removed",
+			state: reconcileState{
+				Firewall: FirewallConfig{CustomInterfaceRules: []CustomInterfaceRule{
+					newPeerRule("10.7.0.0/16", []string{}, []string{"lab"}, testContainerIP),
+				}},
+			},
+			want: []string{"delete 10.7.0.0/16 lab"},
+		},
+		{
+			name:      "exit routing is flushed on the first pass",
+			firstPass: true,
+			want:      []string{"exitroute-clear"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := tt.state
+			state.ContainerIP = testContainerIP
+			state.PrefsKnown = !tt.prefsUnknown
+			state.ExitRoutingKnown = !tt.firstPass
+			got := describePlan(computePlan(&state))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("computePlan() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// all reconciliation goes through a single worker. triggers that arrive
+// within ReconcileDebounce of each other are folded into one pass, and a
+// trigger that arrives mid-pass schedules exactly one more pass afterwards.
+
+var ReconcileDebounce = 2 * time.Second
+
+type ReconcileRun struct {
+	Started  time.Time
+	Duration string
+	Sources  []string
+	Success  bool
+	Error    string `json:",omitempty"`
+}
+
+type ReconcileStatus struct {
+	Running bool
+	// triggers received since the current or last pass started
+	QueueDepth int
+	Pending    []string
+	LastRun    *ReconcileRun `json:",omitempty"`
+}
+
+type reconciler struct {
+	mtx     sync.Mutex
+	wake    chan struct{}
+	pending []string
+	running bool
+	lastRun *ReconcileRun
+}
+
+var gReconciler = &reconciler{wake: make(chan struct{}, 1)}
+
+// requestRebuild queues a reconciliation pass. source is recorded for /reconcile
+func requestRebuild(source string) {
+	gReconciler.trigger(source)
+}
+
+func (rc *reconciler) trigger(source string) {
+	rc.mtx.Lock()
+	rc.pending = append(rc.pending, source)
+	rc.mtx.Unlock()
+
+	select {
+	case rc.wake <- struct{}{}:
+	default:
+		//a pass is already queued, it will pick up this source
+	}
+}
+
+func (rc *reconciler) run() {
+	for range rc.wake {
+		time.Sleep(ReconcileDebounce)
+
+		rc.mtx.Lock()
+		sources := rc.pending
+		rc.pending = nil
+		//wakeups from the debounce window are covered by this pass
+		select {
+		case <-rc.wake:
+		default:
+		}
+		if len(sources) == 0 {
+			rc.mtx.Unlock()
+			continue
+		}
+		rc.running = true
+		rc.mtx.Unlock()
+
+		started := time.Now()
+		err := rebuildState()
+		gMetrics.observeReconcile(time.Since(started), err)
+
+		result := &ReconcileRun{
+			Started:  started,
+			Duration: time.Since(started).String(),
+			Sources:  sources,
+			Success:  err == nil,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		rc.mtx.Lock()
+		rc.running = false
+		rc.lastRun = result
+		rc.mtx.Unlock()
+
+		publishEvent(EventReconcile, result)
+	}
+}
+
+func (rc *reconciler) status() ReconcileStatus {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	return ReconcileStatus{
+		Running:    rc.running,
+		QueueDepth: len(rc.pending),
+		Pending:    append([]string{}, rc.pending...),
+		LastRun:    rc.lastRun,
+	}
+}
+
+func startReconciler() {
+	go gReconciler.run()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+// subnets other subnet routers advertise on the tailnet (their PrimaryRoutes)
+// can be imported into SPR per group. Config.RouteImports maps a group to the
+// remote prefixes it selects, an advertised route is imported when it lies
+// within one of them. each imported route gets a custom interface rule that
+// routes it via this container and grants the selecting groups access.
+//
+// accepting routes is all or nothing in tailscaled (RouteAll): every route on
+// the tailnet lands in its routing table, not only the imported ones. it is
+// turned on while any import is configured, but only as long as no
+// advertised route overlaps SPR's subnets or the container network, which
+// would otherwise be routed into the tailnet.
+
+type importedRoute struct {
+	Prefix string
+	// hostnames of the routers advertising it
+	Routers []string
+	// SPR groups that selected it, empty if none did
+	Groups []string
+	// why it is not imported even though groups selected it, for routes that
+	// overlap SPR's own subnets or the container's network
+	Conflict string `json:",omitempty"`
+}
+
+func (cfg *Config) acceptRoutes() bool {
+	return len(cfg.RouteImports) > 0
+}
+
+// rules we installed for imported routes: ours by name, but not for a peer
+func isImportedRouteRule(rule *CustomInterfaceRule) bool {
+	return rule.Interface == gSPRTailscaleInterface &&
+		strings.HasPrefix(rule.RuleName, GeneratedRulePrefix) &&
+		strings.Contains(rule.SrcIP, "/") &&
+		!isTailnetIP(rule.SrcIP)
+}
+
+// localConflict returns why prefix cannot be imported, or "" when it does not
+// overlap a network that is already reachable locally
+func localConflict(prefix netip.Prefix, lanSubnets []string, containerNetworks []string) string {
+	overlaps := func(cidr string) bool {
+		local, err := netip.ParsePrefix(cidr)
+		return err == nil && local.Overlaps(prefix)
+	}
+	for _, subnet := range lanSubnets {
+		if overlaps(subnet) {
+			return "overlaps SPR subnet " + subnet
+		}
+	}
+	for _, network := range containerNetworks {
+		if overlaps(network) {
+			return "overlaps the container network " + network
+		}
+	}
+	return ""
+}
+
+// advertisedRoutes lists the subnets routed by peers, with the groups that
+// import each. exit node routes are left out, routes overlapping lanSubnets
+// or containerNetworks are marked as conflicting
+func advertisedRoutes(cfg *Config, peers []tailnetPeer, lanSubnets []string, containerNetworks []string) []importedRoute {
+	byPrefix := map[string]*importedRoute{}
+	for _, peer := range peers {
+		for _, route := range peer.PrimaryRoutes {
+			prefix, err := netip.ParsePrefix(route)
+			if err != nil || prefix.Bits() == 0 {
+				continue
+			}
+			prefix = prefix.Masked()
+
+			entry, ok := byPrefix[prefix.String()]
+			if !ok {
+				entry = &importedRoute{Prefix: prefix.String(), Routers: []string{}, Groups: []string{}}
+				byPrefix[prefix.String()] = entry
+			}
+			entry.Routers = appendUnique(entry.Routers, peer.HostName)
+		}
+	}
+
+	routes := []importedRoute{}
+	for _, route := range sortRoutes(slices.Collect(maps.Keys(byPrefix))) {
+		entry := byPrefix[route]
+		prefix := netip.MustParsePrefix(route)
+		for group, selected := range cfg.RouteImports {
+			for _, cidr := range selected {
+				want, err := netip.ParsePrefix(cidr)
+				if err == nil && want.Bits() <= prefix.Bits() && want.Contains(prefix.Addr()) {
+					entry.Groups = appendUnique(entry.Groups, group)
+				}
+			}
+		}
+		slices.Sort(entry.Groups)
+		entry.Conflict = localConflict(prefix, lanSubnets, containerNetworks)
+		routes = append(routes, *entry)
+	}
+	return routes
+}
+
+// acceptRoutesDecision tells whether tailscaled should accept routes. when
+// imports are configured but a conflicting route blocks accepting, the reason
+// is returned
+func acceptRoutesDecision(cfg *Config, peers []tailnetPeer, lanSubnets []string, containerNetworks []string) (bool, string) {
+	if !cfg.acceptRoutes() {
+		return false, ""
+	}
+	for _, route := range advertisedRoutes(cfg, peers, lanSubnets, containerNetworks) {
+		if route.Conflict != "" {
+			return false, route.Prefix + " from " + strings.Join(route.Routers, ",") + " " + route.Conflict
+		}
+	}
+	return true, ""
+}
+
+// setAcceptRoutes switches tailscaled's RouteAll pref
+func setAcceptRoutes(accept bool) error {
+	client := tailscale.LocalClient{
+		Socket:        UNIX_TAILSCALE_SOCK,
+		UseSocketOnly: true,
+	}
+
+	_, err := client.EditPrefs(context.Background(), &ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{RouteAll: accept},
+		RouteAllSet: true,
+	})
+	auditResult(AuditEntry{Kind: AuditRoutes, Action: "accept-routes", Detail: accept}, err)
+	if err != nil {
+		return err
+	}
+	gAdvertised.setAcceptRoutes(accept)
+	return nil
+}
+
+// the advertised routes at least one group imports and that do not conflict
+// with a local network
+func computeImportedRoutes(cfg *Config, peers []tailnetPeer, lanSubnets []string, containerNetworks []string) []importedRoute {
+	imported := []importedRoute{}
+	for _, route := range advertisedRoutes(cfg, peers, lanSubnets, containerNetworks) {
+		if len(route.Groups) > 0 && route.Conflict == "" {
+			imported = append(imported, route)
+		}
+	}
+	return imported
+}
+
+type RouteImportsView struct {
+	Imports map[string][]string
+	// every subnet advertised on the tailnet and who imports it
+	Advertised []importedRoute
+	// whether tailscaled should be accepting routes, and what blocks it
+	AcceptRoutes bool
+	Blocked      string `json:",omitempty"`
+}
+
+func (tsp *tailscalePlugin) handleGetRouteImports(w http.ResponseWriter, r *http.Request) {
+	tsp.clientMtx.Lock()
+	status, err := tsp.cachedStatus(r.Context())
+	tsp.clientMtx.Unlock()
+	if err != nil {
+		httpInternalError("Getting tailscale status failed", err, w)
+		return
+	}
+
+	peers := []tailnetPeer{}
+	for _, peer := range status.Peer {
+		peers = append(peers, peerStatusToTailnetPeer(status, peer))
+	}
+
+	lanSubnets, err := getSPRSubnets()
+	if err != nil {
+		httpInternalError("Getting SPR subnets failed", err, w)
+		return
+	}
+	containerNetworks := getContainerNetworks()
+
+	Configmtx.RLock()
+	view := RouteImportsView{
+		Imports:    maps.Clone(gConfig.RouteImports),
+		Advertised: advertisedRoutes(&gConfig, peers, lanSubnets, containerNetworks),
+	}
+	view.AcceptRoutes, view.Blocked = acceptRoutesDecision(&gConfig, peers, lanSubnets, containerNetworks)
+	Configmtx.RUnlock()
+	if view.Imports == nil {
+		view.Imports = map[string][]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(view); err != nil {
+		httpInternalError("Encoding route imports failed", err, w)
+		return
+	}
+}
+
+// PUT sets the remote prefixes a group imports, DELETE stops importing for it
+func (tsp *tailscalePlugin) handleSetRouteImports(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	candidate := gConfig
+	candidate.RouteImports = maps.Clone(gConfig.RouteImports)
+	if candidate.RouteImports == nil {
+		candidate.RouteImports = map[string][]string{}
+	}
+
+	if r.Method == http.MethodPut {
+		prefixes := []string{}
+		if err := json.NewDecoder(r.Body).Decode(&prefixes); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		candidate.RouteImports[group] = prefixes
+		if err := validateConfigSections(&candidate, "RouteImports"); err != nil {
+			httpValidationError(err, w)
+			return
+		}
+	} else {
+		if _, exists := candidate.RouteImports[group]; !exists {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		delete(candidate.RouteImports, group)
+	}
+
+	gConfig.RouteImports = candidate.RouteImports
+	if err := writeConfigLocked(r.Context()); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	requestRebuild("api:imports")
+}
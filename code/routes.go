@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// how the SPR devices of a group are advertised to the tailnet, set per
+// group in Config.GroupRoutes. a /30 per device is the default, the coarser
+// modes keep route approvals stable on sites where devices come and go.
+
+const (
+	RouteModeHost     = "host"     //a /32 or /128 per device
+	RouteModeDevice   = "device"   //a /30 per device, the SPR tiny subnet
+	RouteModeSupernet = "supernet" //the SPR LAN subnets as a whole
+	RouteModeCIDRs    = "cidrs"    //exactly the listed CIDRs
+)
+
+var RouteModes = []string{RouteModeHost, RouteModeDevice, RouteModeSupernet, RouteModeCIDRs}
+
+type GroupRoutes struct {
+	Mode  string   `validate:"routemode"`
+	CIDRs []string `json:",omitempty" validate:"cidrs"`
+}
+
+func (cfg *Config) routeMode(group string) string {
+	if routes, ok := cfg.GroupRoutes[group]; ok && routes.Mode != "" {
+		return routes.Mode
+	}
+	return RouteModeDevice
+}
+
+// whether any group is advertised as the LAN supernet, which needs the
+// subnets from SPR
+func (cfg *Config) needsLANSubnets() bool {
+	for _, routes := range cfg.GroupRoutes {
+		if routes.Mode == RouteModeSupernet {
+			return true
+		}
+	}
+	return false
+}
+
+// groups that tailscale peer rules grant access to
+func tailscaleRuleGroups(rules []CustomInterfaceRule) []string {
+	groups := []string{}
+	for _, custom := range rules {
+		//imported subnets are reached through the tailnet, not advertised to it
+		if custom.Interface != gSPRTailscaleInterface || isImportedRouteRule(&custom) {
+			continue
+		}
+		for _, group := range custom.Groups {
+			if !slices.Contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// computeSPRRoutes returns the routes for every group that tailscale rules
+// reference, each advertised according to its mode. lanSubnets may be nil
+// when no group uses RouteModeSupernet.
+func computeSPRRoutes(cfg *Config, rules []CustomInterfaceRule, devices map[string]DeviceEntry, lanSubnets []string) []string {
+	routes := []string{}
+	add := func(route string) {
+		if !slices.Contains(routes, route) {
+			routes = append(routes, route)
+		}
+	}
+
+	for _, group := range tailscaleRuleGroups(rules) {
+		mode := cfg.routeMode(group)
+		switch mode {
+		case RouteModeSupernet:
+			for _, subnet := range lanSubnets {
+				add(subnet)
+			}
+			continue
+		case RouteModeCIDRs:
+			for _, cidr := range cfg.GroupRoutes[group].CIDRs {
+				add(cidr)
+			}
+			continue
+		}
+
+		for _, device := range devices {
+			if device.RecentIP == "" || !slices.Contains(device.Groups, group) {
+				continue
+			}
+			if mode == RouteModeHost {
+				add(toHostPrefix(device.RecentIP))
+			} else {
+				add(toSubnet(device.RecentIP))
+			}
+		}
+	}
+
+	return aggregateRoutes(routes)
+}
+
+// sortRoutes orders prefixes by family, address and length, invalid ones are dropped
+func sortRoutes(routes []string) []string {
+	prefixes := []netip.Prefix{}
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			fmt.Println("[-] Ignoring invalid route", route)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixStrings(sortPrefixes(prefixes))
+}
+
+func sortPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	return slices.Compact(prefixes)
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	routes := []string{}
+	for _, prefix := range prefixes {
+		routes = append(routes, prefix.String())
+	}
+	return routes
+}
+
+// aggregateRoutes collapses routes into the fewest prefixes covering exactly
+// the same addresses: covered prefixes are dropped and two halves of a
+// prefix are merged into it. nothing outside the input is ever covered.
+func aggregateRoutes(routes []string) []string {
+	prefixes := []netip.Prefix{}
+	for _, route := range sortRoutes(routes) {
+		prefixes = append(prefixes, netip.MustParsePrefix(route))
+	}
+
+	for {
+		merged := []netip.Prefix{}
+		changed := false
+		for _, prefix := range prefixes {
+			if len(merged) == 0 {
+				merged = append(merged, prefix)
+				continue
+			}
+			last := merged[len(merged)-1]
+			if last.Contains(prefix.Addr()) && last.Bits() <= prefix.Bits() {
+				//sorted by address, so a covering prefix comes first
+				changed = true
+				continue
+			}
+			if last.Bits() == prefix.Bits() && last.Bits() > 0 {
+				parent, _ := last.Addr().Prefix(last.Bits() - 1)
+				if parent.Addr() == last.Addr() && parent.Contains(prefix.Addr()) {
+					merged[len(merged)-1] = parent
+					changed = true
+					continue
+				}
+			}
+			merged = append(merged, prefix)
+		}
+		prefixes = merged
+		if !changed {
+			break
+		}
+	}
+
+	return prefixStrings(prefixes)
+}
+
+// what the last successful advertiseRoutes sent, used to skip up.sh when
+// tailscaled's prefs cannot be read
+type advertisedCache struct {
+	mtx          sync.Mutex
+	known        bool
+	routes       []string
+	exitNode     bool
+	acceptRoutes bool
+}
+
+var gAdvertised = &advertisedCache{}
+
+func (ac *advertisedCache) set(routes []string, exitNode bool, acceptRoutes bool) {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	ac.known = true
+	ac.routes = slices.Clone(routes)
+	ac.exitNode = exitNode
+	ac.acceptRoutes = acceptRoutes
+}
+
+// after RouteAll alone was changed
+func (ac *advertisedCache) setAcceptRoutes(acceptRoutes bool) {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	ac.acceptRoutes = acceptRoutes
+}
+
+func (ac *advertisedCache) reset() {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	ac.known = false
+	ac.routes = nil
+	ac.exitNode = false
+	ac.acceptRoutes = false
+}
+
+func (ac *advertisedCache) get() (bool, []string, bool, bool) {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	return ac.known, slices.Clone(ac.routes), ac.exitNode, ac.acceptRoutes
+}
+
+func (tsp *tailscalePlugin) handleGetGroupRoutes(w http.ResponseWriter, r *http.Request) {
+	Configmtx.RLock()
+	defer Configmtx.RUnlock()
+
+	routes := gConfig.GroupRoutes
+	if routes == nil {
+		routes = map[string]GroupRoutes{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(routes); err != nil {
+		httpInternalError("Encoding group routes failed", err, w)
+		return
+	}
+}
+
+// PUT sets the advertisement mode of a group, DELETE returns it to the default
+func (tsp *tailscalePlugin) handleSetGroupRoutes(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	if r.Method == http.MethodPut {
+		routes := GroupRoutes{}
+		if err := json.NewDecoder(r.Body).Decode(&routes); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		candidate := gConfig
+		candidate.GroupRoutes = maps.Clone(gConfig.GroupRoutes)
+		if candidate.GroupRoutes == nil {
+			candidate.GroupRoutes = map[string]GroupRoutes{}
+		}
+		candidate.GroupRoutes[group] = routes
+		if err := validateConfigSections(&candidate, "GroupRoutes"); err != nil {
+			httpValidationError(err, w)
+			return
+		}
+		gConfig.GroupRoutes = candidate.GroupRoutes
+	} else {
+		if _, exists := gConfig.GroupRoutes[group]; !exists {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		delete(gConfig.GroupRoutes, group)
+	}
+
+	if err := writeConfigLocked(r.Context()); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	requestRebuild("api:routes")
+}
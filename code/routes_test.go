@@ -0,0 +1,150 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAggregateRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		want   []string
+	}{
+		{
+			name:   "empty",
+			routes: []string{},
+			want:   []string{},
+		},
+		{
+			name:   "adjacent /30s merge into a /29",
+			routes: []string{"192.168.2.4/30", "192.168.2.0/30"},
+			want:   []string{"192.168.2.0/29"},
+		},
+		{
+			name:   "four /30s merge into a /28",
+			routes: []string{"192.168.2.0/30", "192.168.2.4/30", "192.168.2.8/30", "192.168.2.12/30"},
+			want:   []string{"192.168.2.0/28"},
+		},
+		{
+			name:   "neighbours in different halves stay apart",
+			routes: []string{"192.168.2.4/30", "192.168.2.8/30"},
+			want:   []string{"192.168.2.4/30", "192.168.2.8/30"},
+		},
+		{
+			name:   "prefixes of different length do not merge",
+			routes: []string{"192.168.2.0/30", "192.168.2.4/31"},
+			want:   []string{"192.168.2.0/30", "192.168.2.4/31"},
+		},
+		{
+			name:   "covered prefixes are dropped",
+			routes: []string{"10.1.0.0/16", "10.1.2.3/32", "10.0.0.0/8"},
+			want:   []string{"10.0.0.0/8"},
+		},
+		{
+			name:   "duplicates and host bits",
+			routes: []string{"192.168.2.5/30", "192.168.2.4/30"},
+			want:   []string{"192.168.2.4/30"},
+		},
+		{
+			name:   "invalid routes are dropped",
+			routes: []string{"bogus", "192.168.2.4/30"},
+			want:   []string{"192.168.2.4/30"},
+		},
+		{
+			name:   "mixed families",
+			routes: []string{"2001:db8:0:1::/64", "192.168.2.0/30", "2001:db8::/64", "192.168.2.4/30"},
+			want:   []string{"192.168.2.0/29", "2001:db8::/63"},
+		},
+		{
+			name:   "IPv4 and IPv6 never merge",
+			routes: []string{"0.0.0.0/1", "::/1"},
+			want:   []string{"0.0.0.0/1", "::/1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregateRoutes(tt.routes)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("aggregateRoutes(%v) = %v, want %v", tt.routes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeSPRRoutes(t *testing.T) {
+	rules := []CustomInterfaceRule{
+		newPeerRule("100.64.0.1", []string{}, []string{"lab"}, "192.168.2.50"),
+		//other interfaces and imported routes are not advertised
+		{Interface: "wg0", SrcIP: "192.168.3.1", Groups: []string{"other"}},
+		newPeerRule("10.9.0.0/16", []string{}, []string{"imported"}, "192.168.2.50"),
+	}
+	devices := map[string]DeviceEntry{
+		"a": {RecentIP: "192.168.2.6", Groups: []string{"lab"}},
+		"b": {RecentIP: "192.168.2.10", Groups: []string{"lab"}},
+		"c": {RecentIP: "2001:db8:1:2::5", Groups: []string{"lab"}},
+		"d": {RecentIP: "192.168.2.14", Groups: []string{"other", "imported"}},
+		"e": {Groups: []string{"lab"}},
+	}
+	lanSubnets := []string{"192.168.2.0/24", "192.168.3.0/24"}
+
+	tests := []struct {
+		name   string
+		routes GroupRoutes
+		want   []string
+	}{
+		{
+			name: "device is the default",
+			want: []string{"192.168.2.4/30", "192.168.2.8/30", "2001:db8:1:2::5/128"},
+		},
+		{
+			name:   "device",
+			routes: GroupRoutes{Mode: RouteModeDevice},
+			want:   []string{"192.168.2.4/30", "192.168.2.8/30", "2001:db8:1:2::5/128"},
+		},
+		{
+			name:   "host",
+			routes: GroupRoutes{Mode: RouteModeHost},
+			want:   []string{"192.168.2.6/32", "192.168.2.10/32", "2001:db8:1:2::5/128"},
+		},
+		{
+			name:   "supernet",
+			routes: GroupRoutes{Mode: RouteModeSupernet},
+			want:   []string{"192.168.2.0/23"},
+		},
+		{
+			name:   "cidrs",
+			routes: GroupRoutes{Mode: RouteModeCIDRs, CIDRs: []string{"172.16.1.0/24", "172.16.0.0/24"}},
+			want:   []string{"172.16.0.0/23"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{GroupRoutes: map[string]GroupRoutes{}}
+			if tt.routes.Mode != "" {
+				cfg.GroupRoutes["lab"] = tt.routes
+			}
+			got := computeSPRRoutes(cfg, rules, devices, lanSubnets)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("computeSPRRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToHostPrefix(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.2.6", "192.168.2.6/32"},
+		{"2001:db8:1:2::5", "2001:db8:1:2::5/128"},
+	}
+	for _, tt := range tests {
+		if got := toHostPrefix(tt.ip); got != tt.want {
+			t.Errorf("toHostPrefix(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
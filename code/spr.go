@@ -5,16 +5,18 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"reflect"
-	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,7 +24,6 @@ import (
 
 import (
 	sprbus "github.com/spr-networks/sprbus-json"
-	"tailscale.com/client/tailscale"
 )
 
 var TEST_PREFIX = os.Getenv("TEST_PREFIX")
@@ -35,21 +36,65 @@ func init() {
 }
 
 type TailscalePeer struct {
+	StableID string //tailscale StableNodeID, survives re-keying and readdressing
 	NodeKey  string
-	IP       string
-	Policies []string
-	Groups   []string
+	IP       string   `validate:"tailnetip"` //derived, refreshed from the netmap
+	Policies []string `validate:"policies"`
+	Groups   []string `validate:"groups"`
 	Tags     []string //unused for now
+	Profiles []string `json:",omitempty"` //names of AccessProfiles in Config
+	Notes    string   `json:",omitempty"`
+}
+
+func trimNodeKey(key string) string {
+	return strings.TrimPrefix(key, "nodekey:")
+}
+
+// Matches reports whether this entry configures the given peer. The StableID
+// decides when both sides have one, older entries fall back to node key or IP.
+func (p *TailscalePeer) Matches(stableID string, nodeKey string, ip string) bool {
+	if p.StableID != "" && stableID != "" {
+		return p.StableID == stableID
+	}
+	if p.NodeKey != "" && nodeKey != "" && trimNodeKey(p.NodeKey) == trimNodeKey(nodeKey) {
+		return true
+	}
+	return p.IP != "" && p.IP == ip
 }
 
 type Config struct {
+	Version           int //see ConfigVersion
 	TailscaleAuthKey  string
 	APIToken          string
 	AdvertiseExitNode bool
-	Peers             []TailscalePeer
+	// set by PUT /down, cleared by PUT /up. while set, rebuildState leaves
+	// tailscaled and the SPR rules alone so a restart does not bring the
+	// link back up.
+	AdministrativelyDown bool
+	Peers                []TailscalePeer
+	// access for peers without a Peers entry, by tailscale ACL tag
+	TagRules []TagRule
+	// access for peers without a Peers entry, by owner login name
+	UserRules []UserRule
+	// access for peers without a Peers entry, by hostname and OS. first match wins
+	HostRules []HostRule
+	// given to every peer without a Peers entry. empty means "tailnet",
+	// "none" grants nothing so unmapped peers are quarantined.
+	DefaultGroups   []string `validate:"groups"`
+	DefaultPolicies []string `validate:"policies=none"`
+	// named bundles of groups and policies, referenced by peers and rules
+	Profiles map[string]AccessProfile
+	// how each group's devices are advertised to the tailnet, see routes.go
+	GroupRoutes map[string]GroupRoutes
+	// group -> remote prefixes imported from other subnet routers, see routeimport.go
+	RouteImports map[string][]string
+	// answer MagicDNS names for SPR devices, see dnsforward.go
+	DNSForwarder bool
+	// tailnet exit node for the SPR devices in ExitNode.Group
+	ExitNode ExitNodeConfig
 }
 
-var gConfig = Config{}
+var gConfig = Config{Version: ConfigVersion}
 
 var DevicesPublicConfigFile = TEST_PREFIX + "/state/public/devices-public.json"
 var ConfigFile = TEST_PREFIX + "/configs/spr-tailscale/config.json"
@@ -57,6 +102,17 @@ var TailscaleEnvFile = TEST_PREFIX + "/configs/spr-tailscale/config.sh"
 var PluginTokenPath = TEST_PREFIX + "/configs/spr-tailscale/api-token"
 var gDefaultGroups = []string{"tailnet"}
 
+// prefix of every custom interface rule this plugin installs into SPR
+var GeneratedRulePrefix = "GeneratedTailscale-"
+
+// names rules whose access the plugin derived from config, so it can be
+// taken away again once nothing grants it
+var ManagedRulePrefix = GeneratedRulePrefix + "managed-"
+
+func isManagedRule(rule *CustomInterfaceRule) bool {
+	return strings.HasPrefix(rule.RuleName, ManagedRulePrefix)
+}
+
 type DeviceEntry struct {
 	Name       string
 	MAC        string
@@ -140,13 +196,12 @@ func APIDevices() (map[string]DeviceEntry, error) {
 	return devs, nil
 }
 
-func getSPRFirewallConfig() (FirewallConfig, error) {
-	firewallConfig := FirewallConfig{}
-
+// sprAPIGet decodes the JSON response of a GET request to the SPR API
+func sprAPIGet(path string, out interface{}) error {
 	gw, err := getGateway()
 	if err != nil {
 		fmt.Println("[-] Could not retrieve SPR API from gateway address")
-		return firewallConfig, err
+		return err
 	}
 
 	cli := http.Client{
@@ -155,19 +210,19 @@ func getSPRFirewallConfig() (FirewallConfig, error) {
 
 	defer cli.CloseIdleConnections()
 
-	req, err := http.NewRequest(http.MethodGet, "http://"+gw+":80/firewall/config", nil)
+	req, err := http.NewRequest(http.MethodGet, "http://"+gw+":80"+path, nil)
 	if err != nil {
 		fmt.Println(err)
-		return firewallConfig, err
+		return err
 	}
 
 	Configmtx.RLock()
 	token := gConfig.APIToken
 	Configmtx.RUnlock()
 
-	if gConfig.APIToken == "" {
+	if token == "" {
 		fmt.Println("[-] Missing auth token")
-		return firewallConfig, fmt.Errorf("missing auth token")
+		return fmt.Errorf("missing auth token")
 	}
 
 	req.Header.Add("Authorization", "Bearer "+token)
@@ -175,21 +230,37 @@ func getSPRFirewallConfig() (FirewallConfig, error) {
 	resp, err := cli.Do(req)
 	if err != nil {
 		fmt.Println("request failed", err)
-		return firewallConfig, err
+		countSPRAPIError(0)
+		return err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
-		return firewallConfig, fmt.Errorf("API error", resp.StatusCode)
+		countSPRAPIError(resp.StatusCode)
+		return fmt.Errorf("API error %d", resp.StatusCode)
 	}
 
-	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&firewallConfig)
-	if err != nil {
-		return firewallConfig, err
-	}
+func getSPRFirewallConfig() (FirewallConfig, error) {
+	firewallConfig := FirewallConfig{}
+	err := sprAPIGet("/firewall/config", &firewallConfig)
+	return firewallConfig, err
+}
+
+type SubnetConfig struct {
+	TinyNets []string
+}
 
-	return firewallConfig, nil
+// the LAN subnets SPR hands device addresses out of
+func getSPRSubnets() ([]string, error) {
+	subnets := SubnetConfig{}
+	if err := sprAPIGet("/subnetConfig", &subnets); err != nil {
+		return nil, err
+	}
+	return subnets.TinyNets, nil
 }
 
 func TwiddleTinyIP(net_ip net.IP, delta int) net.IP {
@@ -201,69 +272,51 @@ func TinyIpDelta(IP string, delta int) string {
 	return TwiddleTinyIP(net.ParseIP(IP), delta).String()
 }
 
-func toSubnet(IP string) string {
-	return TinyIpDelta(IP, -2) + "/30"
-}
-
-func getSPRRoutes() ([]string, error) {
-	connected_subnets := []string{}
-
-	//grab devices
-	devices, err := APIDevices()
-	if err != nil {
-		return connected_subnets, err
+// toHostPrefix returns the single address prefix for IP, /32 or /128
+func toHostPrefix(IP string) string {
+	if addr, err := netip.ParseAddr(IP); err == nil && !addr.Is4() {
+		return IP + "/128"
 	}
+	return IP + "/32"
+}
 
-	//get all routes
-	config, err := getSPRFirewallConfig()
-	if err != nil {
-		return connected_subnets, err
-	}
-
-	all_groups := []string{}
-	all_srcips := []string{}
-	custom_interfaces := config.CustomInterfaceRules
-	// gather all groups for "tailscale"
-	for _, custom := range custom_interfaces {
-		if custom.Interface == gSPRTailscaleInterface {
-			for _, group := range custom.Groups {
-				if !slices.Contains(all_groups, group) {
-					all_groups = append(all_groups, group)
-				}
-			}
-
-			if !slices.Contains(all_srcips, custom.SrcIP) {
-				all_srcips = append(all_srcips, custom.SrcIP)
-			}
-		}
+// the SPR tiny subnet of a device. SPR does not split IPv6 per device, so
+// an IPv6 device is routed on its own address
+func toSubnet(IP string) string {
+	if addr, err := netip.ParseAddr(IP); err == nil && !addr.Is4() {
+		return toHostPrefix(IP)
 	}
+	return TinyIpDelta(IP, -2) + "/30"
+}
 
-	//now iterate groups in devices to get each /30
-	for _, device := range devices {
-		if device.RecentIP != "" {
-
-			inGroup := slices.ContainsFunc(device.Groups, func(group string) bool {
-				return slices.Contains(all_groups, group)
-			})
+// updateCustomInterface adds or deletes rule in SPR. rules without a name get
+// the generated one
+func updateCustomInterface(doDelete bool, rule CustomInterfaceRule) (err error) {
+	action := "add"
+	if doDelete {
+		action = "delete"
+	}
+	defer func() {
+		auditResult(AuditEntry{
+			Kind:   AuditFirewall,
+			Action: action,
+			Target: rule.SrcIP,
+			Detail: map[string]interface{}{"RuleName": rule.RuleName, "Groups": rule.Groups, "Policies": rule.Policies, "RouteDst": rule.RouteDst},
+		}, err)
+	}()
 
-			if inGroup {
-				connected_subnets = append(connected_subnets, toSubnet(device.RecentIP))
-			}
-		}
+	ruleName := rule.RuleName
+	if ruleName == "" {
+		ruleName = GeneratedRulePrefix + rule.SrcIP
 	}
-
-	return connected_subnets, nil
-}
-
-func updateCustomInterface(doDelete bool, SrcIP string, Policies []string, Groups []string, RouteDst string) error {
 	custom_interface_rule := CustomInterfaceRule{
-		BaseRule{"GeneratedTailscale-" + SrcIP,
+		BaseRule{ruleName,
 			false},
 		gSPRTailscaleInterface,
-		SrcIP,
-		RouteDst,
-		Policies,
-		Groups,
+		rule.SrcIP,
+		rule.RouteDst,
+		rule.Policies,
+		rule.Groups,
 		[]string{},
 	}
 
@@ -301,36 +354,79 @@ func updateCustomInterface(doDelete bool, SrcIP string, Policies []string, Group
 	resp, err := cli.Do(req)
 	if err != nil {
 		fmt.Println("request failed", err)
+		countSPRAPIError(0)
 		return err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("resp failure " + resp.Status)
+		countSPRAPIError(resp.StatusCode)
+		return fmt.Errorf("resp failure %s", resp.Status)
 	}
 
 	return nil
 }
 
 func loadConfig() error {
-	Configmtx.RLock()
-	defer Configmtx.RUnlock()
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
 	data, err := ioutil.ReadFile(ConfigFile)
 	if err != nil {
 		return err
-	} else {
-		err := json.Unmarshal(data, &gConfig)
-		if err != nil {
+	}
+
+	upgraded, version, err := migrateConfig(data)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(upgraded, &gConfig)
+	if err != nil {
+		return err
+	}
+
+	//a bad entry should not keep the plugin from starting, only warn
+	if err := validateConfig(&gConfig); err != nil {
+		fmt.Println("[-] config.json has invalid entries", err)
+	}
+
+	if version != ConfigVersion {
+		//keep the original around before rewriting it in the new format
+		if err := backupConfigFile(data, version); err != nil {
 			return err
 		}
+		fmt.Printf("[+] Migrated config from version %d to %d\n", version, ConfigVersion)
+		return writeConfigLocked(context.Background())
 	}
 	return nil
 }
 
-func writeConfigLocked() error {
+// writeConfigLocked saves gConfig. when ctx is a request's, what the write
+// changed goes into that request's audit entry
+func writeConfigLocked(ctx context.Context) error {
 	file, _ := json.MarshalIndent(gConfig, "", " ")
-	return ioutil.WriteFile(ConfigFile, file, 0600)
+	old, _ := ioutil.ReadFile(ConfigFile)
+	err := ioutil.WriteFile(ConfigFile, file, 0600)
+	if err == nil && !bytes.Equal(old, file) {
+		recordConfigHistory(old, file)
+		recordConfigWrite(ctx, old, file)
+	}
+	return err
+}
+
+// config.sh is sourced by the scripts that run `tailscale up`
+func writeTailscaleEnvLocked() error {
+	configData := []byte("TAILSCALE_AUTH_KEY=\"" + gConfig.TailscaleAuthKey + "\"\n")
+	if gConfig.AdvertiseExitNode {
+		configData = append(configData, []byte("TAILSCALE_EXIT_NODE=1\n")...)
+	}
+	//exit node routing is not implemented for VIRTUAL_SPR, so up.sh must not
+	//route SPR's own namespace through the exit node either
+	if gConfig.ExitNode.IP != "" && os.Getenv("VIRTUAL_SPR") != "1" {
+		configData = append(configData, []byte("TAILSCALE_USE_EXIT_NODE=\""+gConfig.ExitNode.IP+"\"\n")...)
+	}
+	return ioutil.WriteFile(TailscaleEnvFile, configData, 0600)
 }
 
 func installFirewallRule() {
@@ -380,78 +476,60 @@ func installFirewallRule() {
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println("[-] Error making container interface request:", err)
+		countSPRAPIError(0)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
+		countSPRAPIError(resp.StatusCode)
 		fmt.Println("[-] Failed to install container firewall rule")
 		return
 	}
 }
 
-func advertiseRoutes(routes []string) error {
-	//this script inherits auth key parameters and so on
-	return exec.Command("/scripts/up.sh", "--advertise-routes="+strings.Join(routes, ",")).Run()
-}
-
-// returns a matching list of ips and node keys
-func collectPeerIPs() ([]string, []string) {
-
-	client := tailscale.LocalClient{
-		Socket:        UNIX_TAILSCALE_SOCK,
-		UseSocketOnly: true,
-	}
-
-	tsdStatus, tsdErr := client.Status(context.Background())
-	if tsdErr != nil {
-		fmt.Println("[-] Failed to get status")
-		return []string{}, []string{}
+// delete every GeneratedTailscale-* rule from SPR, used when going down
+func removeGeneratedRules() error {
+	fw, err := getSPRFirewallConfig()
+	if err != nil {
+		return err
 	}
 
-	entries := []string{}
-	keys := []string{}
-	for nodeKey, peer := range tsdStatus.Peer {
-		if len(peer.TailscaleIPs) > 0 {
-			keys = append(keys, nodeKey.String())
-			entries = append(entries, peer.TailscaleIPs[0].String())
+	var lastErr error
+	for _, entry := range fw.CustomInterfaceRules {
+		if entry.Interface != gSPRTailscaleInterface || !strings.HasPrefix(entry.RuleName, GeneratedRulePrefix) {
+			continue
+		}
+		err := updateCustomInterface(true, entry)
+		if err != nil {
+			fmt.Println("[-] Failed to delete peer "+entry.SrcIP, err)
+			lastErr = err
 		}
 	}
-
-	return entries, keys
+	return lastErr
 }
 
-func cleanOldPeers(fw FirewallConfig, tailscaleIPs []string, nodeKeys []string) {
-	//tbd, check for node keys not matching IP?
-
-	for _, entry := range fw.CustomInterfaceRules {
-		if entry.Interface == gSPRTailscaleInterface {
-			found_peer := false
-			//skip non cg nat addrs. we're looking for peers
-			// actual range is 100.64... 100.127.255.255 but we dont care
-			if entry.SrcIP[:4] != "100." {
-				continue
-			}
-
-			for _, ip := range tailscaleIPs {
-				if ip == entry.SrcIP {
-					found_peer = true
-				}
-			}
-
-			if !found_peer {
-				//scanned tailscale ips, IP is not known, remove it
-				err := updateCustomInterface(true, entry.SrcIP, entry.Policies, entry.Groups, entry.RouteDst)
-				if err != nil {
-					fmt.Println("[-] Failed to delete peer "+entry.SrcIP, err)
-				}
-
-			}
-		}
+// advertiseRoutes runs `tailscale up`, which has to mention every setting, so
+// whether routes are accepted is passed along as the plan decided it
+func advertiseRoutes(routes []string, acceptRoutes bool) error {
+	//this script inherits auth key parameters and so on
+	err := exec.Command("/scripts/up.sh", "--advertise-routes="+strings.Join(routes, ","),
+		"--accept-routes="+strconv.FormatBool(acceptRoutes)).Run()
+	auditResult(AuditEntry{Kind: AuditRoutes, Action: "advertise", Detail: routes}, err)
+	if err != nil {
+		gAdvertised.reset()
+		return err
 	}
+
+	Configmtx.RLock()
+	exitNode := gConfig.AdvertiseExitNode
+	Configmtx.RUnlock()
+	gAdvertised.set(routes, exitNode, acceptRoutes)
+	return nil
 }
 
-func getContainerIP() string {
+// the first address of a family on eth0, IPv6 only counts global ones
+func containerAddr(v6 bool) string {
 	iface, err := net.InterfaceByName("eth0")
 	if err != nil {
 		fmt.Println("Error:", err)
@@ -465,94 +543,54 @@ func getContainerIP() string {
 		return ""
 	}
 
-	if len(addrs) > 0 {
-		ip := addrs[0].String()
-		if strings.Contains(ip, "/") {
-			ip = strings.Split(ip, "/")[0]
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if !v6 && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+		if v6 && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP.String()
 		}
-		return ip
 	}
 	return ""
 }
 
-func matchPeerConfig(crule CustomInterfaceRule, ip string, nodeKey string) (bool, []string, []string, []string) {
-	//this routine returns false if peer is configured and different than the interface rule
-	Configmtx.RLock()
-	defer Configmtx.RUnlock()
-
-	for _, peer := range gConfig.Peers {
-		if peer.IP == ip {
-			if peer.NodeKey != nodeKey {
-				return false, peer.Groups, peer.Tags, peer.Policies
-			}
-			ret := slices.Compare(peer.Groups, crule.Groups)
-			if ret == 0 {
-				ret = slices.Compare(peer.Tags, crule.Tags)
-				if ret == 0 {
-					ret = slices.Compare(peer.Policies, crule.Policies)
-					return ret == 0, peer.Groups, peer.Tags, peer.Policies
-				}
-			}
-			return ret == 0, peer.Groups, peer.Tags, peer.Policies
-		}
-	}
-
-	//we return true if not in peers
-	return true, []string{}, []string{}, []string{}
+func getContainerIP() string {
+	return containerAddr(false)
 }
 
-func installNewPeers(fw FirewallConfig, tailscaleIPs []string, nodeKeys []string) {
-	containerIP := getContainerIP()
+// empty when the SPR network has no IPv6
+func getContainerIPv6() string {
+	return containerAddr(true)
+}
 
-	policies := []string{}
-
-	groups := gDefaultGroups
-	for idx, ip := range tailscaleIPs {
-		found_peer := false
-		node_key := nodeKeys[idx]
-		for _, crule := range fw.CustomInterfaceRules {
-			if crule.Interface == gSPRTailscaleInterface && crule.SrcIP == ip {
-				if crule.SrcIP[:4] != "100." {
-					//not a tailscale peer
-					continue
-				}
-				if crule.RouteDst != containerIP {
-					err := updateCustomInterface(true, crule.SrcIP, crule.Policies, crule.Groups, crule.RouteDst)
-					if err != nil {
-						fmt.Println("[-] Failed to migrate peer "+crule.SrcIP, err)
-						found_peer = true
-					}
-					break
-				}
-
-				ok, new_groups, _, new_policies := matchPeerConfig(crule, ip, node_key)
-				if !ok {
-					//delete peer and reinstall
-					groups = new_groups
-					policies = new_policies
-					err := updateCustomInterface(true, crule.SrcIP, crule.Policies, crule.Groups, crule.RouteDst)
-					if err != nil {
-						fmt.Println("[-] Failed to delete peer "+crule.SrcIP, err)
-					}
-					break
-				} else {
-					//peer already established with correct groups
-					//and policies
-					found_peer = true
-					break
-				}
+// the networks on eth0, masked. empty when they cannot be read
+func getContainerNetworks() []string {
+	networks := []string{}
+	iface, err := net.InterfaceByName("eth0")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return networks
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return networks
+	}
 
-			}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
 		}
-
-		if !found_peer {
-			//install this peer
-			err := updateCustomInterface(false, ip, policies, groups, containerIP)
-			if err != nil {
-				fmt.Println("[-] Failed to install peer "+ip, err)
-			}
+		if prefix, err := netip.ParsePrefix(ipnet.String()); err == nil {
+			networks = append(networks, prefix.Masked().String())
 		}
 	}
+	return networks
 }
 
 func rebuildPostrouting() {
@@ -562,28 +600,30 @@ func rebuildPostrouting() {
 		return
 	}
 
-	if !commandOutputContains("nft list tables", "table ip nat") {
-		addTableCmd := "nft add table ip nat"
-		if err := exec.Command("sh", "-c", addTableCmd).Run(); err != nil {
-			fmt.Printf("Failed to add table: %s\nError: %s\n", addTableCmd, err)
-			return
+	for _, family := range []string{"ip", "ip6"} {
+		if !commandOutputContains("nft list tables", "table "+family+" nat") {
+			addTableCmd := "nft add table " + family + " nat"
+			if err := exec.Command("sh", "-c", addTableCmd).Run(); err != nil {
+				fmt.Printf("Failed to add table: %s\nError: %s\n", addTableCmd, err)
+				continue
+			}
 		}
-	}
 
-	if !commandOutputContains("nft list table ip nat", "chain POSTROUTING") {
-		addChainCmd := "nft add chain ip nat POSTROUTING { type nat hook postrouting priority 100 \\; }"
-		if err := exec.Command("sh", "-c", addChainCmd).Run(); err != nil {
-			fmt.Printf("Failed to add chain: %s\nError: %s\n", addChainCmd, err)
-			return
+		if !commandOutputContains("nft list table "+family+" nat", "chain POSTROUTING") {
+			addChainCmd := "nft add chain " + family + " nat POSTROUTING { type nat hook postrouting priority 100 \\; }"
+			if err := exec.Command("sh", "-c", addChainCmd).Run(); err != nil {
+				fmt.Printf("Failed to add chain: %s\nError: %s\n", addChainCmd, err)
+				continue
+			}
 		}
-	}
 
-	ruleExistsCmd := "nft list table ip nat"
-	if !commandOutputContains(ruleExistsCmd, "tailscale0") {
-		addRuleCmd := "nft add rule ip nat POSTROUTING oifname \"tailscale0\" masquerade"
-		if err := exec.Command("sh", "-c", addRuleCmd).Run(); err != nil {
-			fmt.Printf("Failed to add rule: %s\nError: %s\n", addRuleCmd, err)
-			return
+		ruleExistsCmd := "nft list table " + family + " nat"
+		if !commandOutputContains(ruleExistsCmd, "tailscale0") {
+			addRuleCmd := "nft add rule " + family + " nat POSTROUTING oifname \"tailscale0\" masquerade"
+			if err := exec.Command("sh", "-c", addRuleCmd).Run(); err != nil {
+				fmt.Printf("Failed to add rule: %s\nError: %s\n", addRuleCmd, err)
+				continue
+			}
 		}
 	}
 }
@@ -598,51 +638,55 @@ func commandOutputContains(commandStr, searchStr string) bool {
 	}
 	return strings.Contains(out.String(), searchStr)
 }
-func rebuildState() {
 
-	rebuildPostrouting()
+// rebuildState runs one reconciliation pass. only the reconciler calls it,
+// everything else should use requestRebuild.
+func rebuildState() error {
 
-	fw, err := getSPRFirewallConfig()
-	if err != nil {
-		fmt.Println("[-] Failed to load fw config", err.Error())
-		return
+	if administrativelyDown() {
+		//up.sh would bring tailscale back up, leave it alone until PUT /up
+		fmt.Println("[-] Administratively down, skipping rebuild")
+		return nil
 	}
 
-	//first half, get known tailscale peers, and advertise them to SPR
-	tailscaleIPs, nodeKeys := collectPeerIPs()
+	rebuildPostrouting()
 
-	//first remove any peers that dont belong
-	cleanOldPeers(fw, tailscaleIPs, nodeKeys)
+	state, err := gatherReconcileState()
+	if err != nil {
+		fmt.Println("[-] Failed to gather state", err.Error())
+		return err
+	}
 
-	//then install the new ones.
-	installNewPeers(fw, tailscaleIPs, nodeKeys)
+	gMetrics.observeGeneratedRules(state.Firewall.CustomInterfaceRules)
 
-	//second half, get routes for tailscale and advertise them.
-	routes, err := getSPRRoutes()
-	if err != nil {
-		fmt.Println("[-] Failed to get SPR routes to advertise to tailscale")
-		return
+	if refreshPeerIdentities(state.Peers) {
+		fmt.Println("[+] Updated addresses of re-keyed or readdressed peers")
 	}
 
-	err = advertiseRoutes(routes)
-	if err != nil {
-		fmt.Println("[-] Failed to advertise routes to tailscale")
-		return
+	//applyPlan checks again before each action, PUT /down may come in meanwhile
+	plan := computePlan(state)
+	errs := applyPlan(plan)
+	for _, err := range errs {
+		fmt.Println("[-]", err)
 	}
 
 	//publish peers on bus
-	sprbus.Publish("tailscale:peers", tailscaleIPs)
+	sprbus.Publish("tailscale:peers", state.peerIPs())
+
+	return errors.Join(errs...)
 }
 
 func handleDeviceEvent(topic string, value string) {
 	//if there was a device update, do rebuild the state.
-	rebuildState()
+	requestRebuild(topic)
 }
 
 func busListener() {
 	go func() {
 		for i := 30; i > 0; i-- {
+			gBusState.set(true, nil)
 			err := sprbus.HandleEvent("device:", handleDeviceEvent)
+			gBusState.set(false, err)
 			if err != nil {
 				log.Println(err)
 			}
@@ -3,23 +3,29 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/vishvananda/netlink"
 	"gopkg.in/validator.v2"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 )
 
@@ -40,6 +46,11 @@ var gSPRTailscaleInterface = "spr-tailscale"
 type tailscalePlugin struct {
 	clientMtx sync.Mutex
 	tsdClient tailscale.LocalClient
+
+	// last Status seen, refreshed by watchIPNBus
+	statusMtx sync.Mutex
+	status    *ipnstate.Status
+	statusAt  time.Time
 }
 
 func httpInternalError(msg string, err error, w http.ResponseWriter) {
@@ -51,7 +62,7 @@ func (tsp *tailscalePlugin) handleGetPeers(w http.ResponseWriter, r *http.Reques
 	tsp.clientMtx.Lock()
 	defer tsp.clientMtx.Unlock()
 
-	tsdStatus, tsdErr := tsp.tsdClient.Status(r.Context())
+	tsdStatus, tsdErr := tsp.cachedStatus(r.Context())
 	if tsdErr != nil {
 		httpInternalError("Getting tailscale peers failed", tsdErr, w)
 		return
@@ -127,7 +138,7 @@ func (tsp *tailscalePlugin) handleGetTopology(w http.ResponseWriter, r *http.Req
 	tsp.clientMtx.Lock()
 	defer tsp.clientMtx.Unlock()
 
-	tsdStatus, tsdErr := tsp.tsdClient.Status(r.Context())
+	tsdStatus, tsdErr := tsp.cachedStatus(r.Context())
 	if tsdErr != nil {
 		httpInternalError("Getting tailscale status failed", tsdErr, w)
 		return
@@ -246,6 +257,23 @@ func tailscaleErrorDetail(out []byte, status *ipnstate.Status) string {
 }
 
 func (tsp *tailscalePlugin) handleUp(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	wasDown := gConfig.AdministrativelyDown
+	if wasDown {
+		gConfig.AdministrativelyDown = false
+		if err := writeConfigLocked(r.Context()); err != nil {
+			Configmtx.Unlock()
+			httpInternalError("Saving up state failed", err, w)
+			return
+		}
+	}
+	Configmtx.Unlock()
+
+	if wasDown {
+		// reinstall peers and routes withdrawn by /down
+		defer requestRebuild("api:up")
+	}
+
 	tsp.clientMtx.Lock()
 	defer tsp.clientMtx.Unlock()
 
@@ -286,7 +314,11 @@ func (tsp *tailscalePlugin) handleUp(w http.ResponseWriter, r *http.Request) {
 		out, _ := exec.Command("/scripts/up.sh").CombinedOutput()
 
 		newStatus, statusErr := tsp.tsdClient.Status(r.Context())
+		login := AuditEntry{Kind: AuditLogin, Action: "up", Actor: requestActor(r), Target: state}
 		if statusErr == nil && newStatus.BackendState == "Running" {
+			login.Success = true
+			audit(login)
+			publishEvent(EventLogin, map[string]string{"State": "Running", "Message": "tailscale is up"})
 			json.NewEncoder(w).Encode(handleUpResponse{
 				Success: true,
 				Message: "tailscale is up",
@@ -294,6 +326,10 @@ func (tsp *tailscalePlugin) handleUp(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		login.Error = tailscaleErrorDetail(out, newStatus)
+		audit(login)
+		publishEvent(EventLogin, map[string]string{"State": state, "AuthURL": status.AuthURL, "Error": login.Error})
+
 		json.NewEncoder(w).Encode(handleUpResponse{
 			Success: false,
 			Message: "tailscale login failed: " + tailscaleErrorDetail(out, newStatus),
@@ -317,8 +353,98 @@ func (tsp *tailscalePlugin) handleUp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type handleDownRequest struct {
+	// also delete the GeneratedTailscale-* custom interface rules from SPR
+	RemoveRules bool
+}
+
 func (tsp *tailscalePlugin) handleDown(w http.ResponseWriter, r *http.Request) {
-	return
+	req := handleDownRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// persist first so a concurrent rebuildState does not run up.sh again
+	Configmtx.Lock()
+	wasDown := gConfig.AdministrativelyDown
+	gConfig.AdministrativelyDown = true
+	err := writeConfigLocked(r.Context())
+	if err != nil {
+		gConfig.AdministrativelyDown = wasDown
+	}
+	Configmtx.Unlock()
+	if err != nil {
+		httpInternalError("Saving down state failed", err, w)
+		return
+	}
+
+	// wait for a plan action in flight, the ones after it see the down state
+	gApplyMtx.Lock()
+	defer gApplyMtx.Unlock()
+
+	tsp.clientMtx.Lock()
+	defer tsp.clientMtx.Unlock()
+
+	// stop tailscaled and withdraw the advertised routes
+	_, err = tsp.tsdClient.EditPrefs(r.Context(), &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			WantRunning:     false,
+			AdvertiseRoutes: []netip.Prefix{},
+		},
+		WantRunningSet:     true,
+		AdvertiseRoutesSet: true,
+	})
+	if err != nil {
+		// tailscale is still up, so the down state must not stick
+		Configmtx.Lock()
+		gConfig.AdministrativelyDown = wasDown
+		if saveErr := writeConfigLocked(r.Context()); saveErr != nil {
+			fmt.Println("[-] Failed to restore the down state", saveErr)
+		}
+		Configmtx.Unlock()
+		httpInternalError("Bringing tailscale down failed", err, w)
+		return
+	}
+	gAdvertised.reset()
+
+	if req.RemoveRules {
+		if err := removeGeneratedRules(); err != nil {
+			json.NewEncoder(w).Encode(handleUpResponse{
+				Success: false,
+				Message: "tailscale is down, but removing SPR rules failed: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(handleUpResponse{
+		Success: true,
+		Message: "tailscale is down",
+	})
+}
+
+// resolvePeerIdentity completes a peer entry from the live status, matching
+// it by StableID, node key or any of its IPs
+func resolvePeerIdentity(input *TailscalePeer, status *ipnstate.Status) bool {
+	for nodeKey, peer := range status.Peer {
+		primary := ""
+		if len(peer.TailscaleIPs) > 0 {
+			primary = peer.TailscaleIPs[0].String()
+		}
+		matched := input.Matches(string(peer.ID), nodeKey.String(), primary)
+		for _, addr := range peer.TailscaleIPs {
+			//an IPv6 address picks the peer too, but the primary one is stored
+			matched = matched || (input.StableID == "" && input.IP == addr.String())
+		}
+		if matched {
+			input.StableID = string(peer.ID)
+			input.NodeKey = trimNodeKey(nodeKey.String())
+			input.IP = primary
+			return true
+		}
+	}
+	return false
 }
 
 func (tsp *tailscalePlugin) handleSetSPRPeer(w http.ResponseWriter, r *http.Request) {
@@ -329,77 +455,214 @@ func (tsp *tailscalePlugin) handleSetSPRPeer(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if input_peer.IP == "" {
-		http.Error(w, "Need a Peer IP", 400)
+	if input_peer.StableID == "" && input_peer.IP == "" {
+		http.Error(w, "Need a Peer StableID or IP", 400)
 		return
 	}
 
-	//make sure to include Tailnet in the groups
-	found := false
-	for _, entry := range input_peer.Groups {
-		if entry == gDefaultGroups[0] {
-			found = true
-		}
-	}
-	if !found {
-		input_peer.Groups = append(input_peer.Groups, gDefaultGroups[0])
+	//fill in the stable identity from the netmap when only the IP or key is known
+	tsp.clientMtx.Lock()
+	tsdStatus, err := tsp.cachedStatus(r.Context())
+	tsp.clientMtx.Unlock()
+	if err == nil {
+		resolvePeerIdentity(&input_peer, tsdStatus)
 	}
 
 	Configmtx.Lock()
 	defer Configmtx.Unlock()
 
+	idx := findPeerConfigLocked(input_peer.StableID, input_peer.NodeKey, input_peer.IP)
+
 	if r.Method == http.MethodPut {
+		if err := validatePeer(&gConfig, &input_peer); err != nil {
+			httpValidationError(err, w)
+			return
+		}
 		//replace or add a new peer
-		for idx, peer := range gConfig.Peers {
-			matched := false
-			if input_peer.NodeKey != "" && peer.NodeKey == input_peer.NodeKey {
-				matched = true
-			} else if input_peer.IP == peer.IP {
-				matched = true
-			}
+		if err := savePeerConfigLocked(r.Context(), idx, input_peer, "api:setSPRPeer"); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+		return
+	}
+
+	//delete the peer
+	if idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err := deletePeerConfigLocked(r.Context(), idx, "api:setSPRPeer"); err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+// dry run of rebuildState: what would be added, deleted and advertised
+func (tsp *tailscalePlugin) handleGetPlan(w http.ResponseWriter, r *http.Request) {
+	state, err := gatherReconcileState()
+	if err != nil {
+		httpInternalError("Gathering state failed", err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(computePlan(state)); err != nil {
+		httpInternalError("Encoding plan failed", err, w)
+		return
+	}
+}
+
+type ruleTestResult struct {
+	Peer tailnetPeer
+	// the first HostRule the peer matches, -1 for none
+	HostRuleIndex int
+	HostRule      *HostRule `json:",omitempty"`
+	Access        peerAccess
+}
+
+// show which rules apply to a live peer (GET ?peer=StableID, IP or HostName)
+// or to a hypothetical one described in the POST body
+func (tsp *tailscalePlugin) handleRulesTest(w http.ResponseWriter, r *http.Request) {
+	peer := tailnetPeer{}
+
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	} else {
+		id := r.URL.Query().Get("peer")
+		if id == "" {
+			http.Error(w, "Need a peer StableID, IP or HostName", 400)
+			return
+		}
+
+		tsp.clientMtx.Lock()
+		peers, err := collectPeers(&tsp.tsdClient)
+		tsp.clientMtx.Unlock()
+		if err != nil {
+			httpInternalError("Getting tailscale peers failed", err, w)
+			return
+		}
 
-			if matched {
-				gConfig.Peers[idx] = input_peer
-				err := writeConfigLocked()
-				if err == nil {
-					go rebuildState()
-				} else {
-					http.Error(w, err.Error(), 400)
-					return
-				}
-				return
+		found := false
+		for _, entry := range peers {
+			if entry.StableID == id || entry.IP == id || strings.EqualFold(entry.HostName, id) {
+				peer = entry
+				found = true
+				break
 			}
 		}
+		if !found {
+			http.Error(w, "Not found", 404)
+			return
+		}
+	}
 
-		//append if not found
-		gConfig.Peers = append(gConfig.Peers, input_peer)
+	Configmtx.RLock()
+	defer Configmtx.RUnlock()
+
+	result := ruleTestResult{
+		Peer:          peer,
+		HostRuleIndex: matchHostRule(&gConfig, &peer),
+		Access:        resolvePeerAccess(&gConfig, peer),
+	}
+	if result.HostRuleIndex >= 0 {
+		rule := gConfig.HostRules[result.HostRuleIndex]
+		result.HostRule = &rule
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		httpInternalError("Encoding rule test failed", err, w)
 		return
-	} else if r.Method == http.MethodDelete {
-		//delete the peer
-		for idx, peer := range gConfig.Peers {
-			matched := false
-			if input_peer.NodeKey != "" && peer.NodeKey == input_peer.NodeKey {
-				matched = true
-			} else if input_peer.IP == peer.IP {
-				matched = true
-			}
+	}
+}
 
-			if matched {
-				gConfig.Peers = append(gConfig.Peers[:idx], gConfig.Peers[idx+1:]...)
-				err := writeConfigLocked()
-				if err == nil {
-					go rebuildState()
-				} else {
-					http.Error(w, err.Error(), 400)
-					return
-				}
-				return
-			}
+func profileInUse(cfg *Config, name string) bool {
+	for _, peer := range cfg.Peers {
+		if slices.Contains(peer.Profiles, name) {
+			return true
+		}
+	}
+	for _, rule := range cfg.TagRules {
+		if slices.Contains(rule.Profiles, name) {
+			return true
+		}
+	}
+	for _, rule := range cfg.UserRules {
+		if slices.Contains(rule.Profiles, name) {
+			return true
+		}
+	}
+	for _, rule := range cfg.HostRules {
+		if slices.Contains(rule.Profiles, name) {
+			return true
 		}
 	}
-	http.Error(w, "Not found", 404)
-	return
+	return false
+}
+
+func (tsp *tailscalePlugin) handleGetProfiles(w http.ResponseWriter, r *http.Request) {
+	Configmtx.RLock()
+	defer Configmtx.RUnlock()
 
+	profiles := gConfig.Profiles
+	if profiles == nil {
+		profiles = map[string]AccessProfile{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(profiles); err != nil {
+		httpInternalError("Encoding profiles failed", err, w)
+		return
+	}
+}
+
+// PUT replaces a profile, every peer using it is updated in the next pass
+func (tsp *tailscalePlugin) handleSetProfile(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	if r.Method == http.MethodPut {
+		profile := AccessProfile{}
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := validator.Validate(profile); err != nil {
+			httpValidationError(err, w)
+			return
+		}
+		if gConfig.Profiles == nil {
+			gConfig.Profiles = map[string]AccessProfile{}
+		}
+		gConfig.Profiles[name] = profile
+	} else {
+		if _, exists := gConfig.Profiles[name]; !exists {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		if profileInUse(&gConfig, name) {
+			http.Error(w, "Profile is in use", 400)
+			return
+		}
+		delete(gConfig.Profiles, name)
+	}
+
+	if err := writeConfigLocked(r.Context()); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	requestRebuild("api:profiles")
+}
+
+func (tsp *tailscalePlugin) handleGetReconcile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(gReconciler.status()); err != nil {
+		httpInternalError("Encoding reconcile status failed", err, w)
+		return
+	}
 }
 
 func (tsp *tailscalePlugin) handleGetSetConfig(w http.ResponseWriter, r *http.Request) {
@@ -435,6 +698,14 @@ func (tsp *tailscalePlugin) handleGetSetConfig(w http.ResponseWriter, r *http.Re
 			return
 		}
 
+		candidate := gConfig
+		candidate.TailscaleAuthKey = cfg.TailscaleAuthKey
+		candidate.AdvertiseExitNode = cfg.AdvertiseExitNode
+		if err := validateConfigSections(&candidate, "TailscaleAuthKey", "AdvertiseExitNode"); err != nil {
+			httpValidationError(err, w)
+			return
+		}
+
 		tokendata, err := ioutil.ReadFile(PluginTokenPath)
 		if err != nil {
 			http.Error(w, "Missing SPR API Key", 400)
@@ -444,19 +715,14 @@ func (tsp *tailscalePlugin) handleGetSetConfig(w http.ResponseWriter, r *http.Re
 		gConfig.TailscaleAuthKey = cfg.TailscaleAuthKey
 		gConfig.AdvertiseExitNode = cfg.AdvertiseExitNode
 		gConfig.APIToken = string(tokendata)
-		err = writeConfigLocked()
+		err = writeConfigLocked(r.Context())
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
 		}
 
-		configData := []byte("TAILSCALE_AUTH_KEY=\"" + gConfig.TailscaleAuthKey + "\"\n")
-		if gConfig.AdvertiseExitNode {
-			configData = append(configData, []byte("TAILSCALE_EXIT_NODE=1\n")...)
-		}
-
 		//also write the tailscale config now
-		err = ioutil.WriteFile(TailscaleEnvFile, configData, 0600)
+		err = writeTailscaleEnvLocked()
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
@@ -515,7 +781,7 @@ func routeTracker() {
 	// Listen for updates
 	for _ = range updates {
 		//Src, Dst/ Iifname, Oifname
-		rebuildState()
+		requestRebuild("route")
 	}
 
 }
@@ -548,13 +814,14 @@ func main() {
 	if socketPath := os.Getenv("SPR_KRUN_PLUGIN_SOCKET"); socketPath != "" {
 		UNIX_PLUGIN_LISTENER = socketPath
 	}
-	loadConfig()
-
-	if err := validator.SetValidationFunc("ipv4", isValidIPv4); err != nil {
+	if err := registerValidators(); err != nil {
 		return
 	}
-	if err := validator.SetValidationFunc("duration", isValidDuration); err != nil {
-		return
+
+	if err := loadConfig(); errors.Is(err, errConfigTooNew) || errors.Is(err, errConfigVersionInvalid) {
+		log.Fatal(err)
+	} else if err != nil {
+		fmt.Println("[-] Failed to load config", err)
 	}
 
 	plugin := tailscalePlugin{
@@ -564,20 +831,49 @@ func main() {
 		},
 	}
 
-	rebuildState()
+	startReconciler()
+	requestRebuild("startup")
+
+	go plugin.watchIPNBus()
 
 	unix_plugin_router := mux.NewRouter().StrictSlash(true)
 
 	unix_plugin_router.HandleFunc("/config", plugin.handleGetSetConfig).Methods("GET", "PUT")
+	unix_plugin_router.HandleFunc("/config/history", plugin.handleGetConfigHistory).Methods("GET")
+	unix_plugin_router.HandleFunc("/config/rollback/{id}", plugin.handleConfigRollback).Methods("POST")
 	//unix_plugin_router.HandleFunc("/reauth", plugin.handleReauth).Methods("POST")
 	unix_plugin_router.HandleFunc("/status", plugin.handleGetStatus).Methods("GET")
 	unix_plugin_router.HandleFunc("/peers", plugin.handleGetPeers).Methods("GET")
 	unix_plugin_router.HandleFunc("/topology", plugin.handleGetTopology).Methods("GET")
+	unix_plugin_router.HandleFunc("/plan", plugin.handleGetPlan).Methods("GET")
+	unix_plugin_router.HandleFunc("/reconcile", plugin.handleGetReconcile).Methods("GET")
+	unix_plugin_router.HandleFunc("/audit", plugin.handleGetAudit).Methods("GET")
+	unix_plugin_router.HandleFunc("/events", plugin.handleEvents).Methods("GET")
+	unix_plugin_router.HandleFunc("/healthz", plugin.handleHealthz).Methods("GET")
+	unix_plugin_router.HandleFunc("/readyz", plugin.handleReadyz).Methods("GET")
+	unix_plugin_router.HandleFunc("/metrics", plugin.handleMetrics).Methods("GET")
+	unix_plugin_router.HandleFunc("/rules/test", plugin.handleRulesTest).Methods("GET", "POST")
+	unix_plugin_router.HandleFunc("/profiles", plugin.handleGetProfiles).Methods("GET")
+	unix_plugin_router.HandleFunc("/profiles/{name}", plugin.handleSetProfile).Methods("PUT", "DELETE")
+	unix_plugin_router.HandleFunc("/routes", plugin.handleGetGroupRoutes).Methods("GET")
+	unix_plugin_router.HandleFunc("/routes/{group}", plugin.handleSetGroupRoutes).Methods("PUT", "DELETE")
+	unix_plugin_router.HandleFunc("/imports", plugin.handleGetRouteImports).Methods("GET")
+	unix_plugin_router.HandleFunc("/imports/{group}", plugin.handleSetRouteImports).Methods("PUT", "DELETE")
 
 	unix_plugin_router.HandleFunc("/setSPRPeer", plugin.handleSetSPRPeer).Methods("DELETE", "PUT")
+	unix_plugin_router.HandleFunc("/peers/config", plugin.handleGetPeerConfigs).Methods("GET")
+	unix_plugin_router.HandleFunc("/peers/export", plugin.handleExportPeers).Methods("GET")
+	unix_plugin_router.HandleFunc("/peers/import", plugin.handleImportPeers).Methods("POST")
+	unix_plugin_router.HandleFunc("/peers/{id}/config", plugin.handlePeerConfig).Methods("GET", "PUT", "PATCH", "DELETE")
+
+	unix_plugin_router.HandleFunc("/exitnode", plugin.handleGetExitNode).Methods("GET")
+	unix_plugin_router.HandleFunc("/exitnode", plugin.handleSetExitNode).Methods("PUT", "DELETE")
+
+	unix_plugin_router.HandleFunc("/dns", plugin.handleGetDNS).Methods("GET")
+	unix_plugin_router.HandleFunc("/dns", plugin.handleSetDNS).Methods("PUT")
 
 	unix_plugin_router.HandleFunc("/up", plugin.handleUp).Methods("PUT")
-	//unix_plugin_router.HandleFunc("/down", plugin.handleDown).Methods("PUT")
+	unix_plugin_router.HandleFunc("/down", plugin.handleDown).Methods("PUT")
 
 	// map /ui to /ui on fs
 	spa := spaHandler{staticPath: "/ui", indexPath: "index.html"}
@@ -590,8 +886,18 @@ func main() {
 	}
 
 	busListener()
+	startHealthMonitor()
+
+	Configmtx.RLock()
+	dnsEnabled := gConfig.DNSForwarder
+	Configmtx.RUnlock()
+	if dnsEnabled {
+		if err := plugin.startDNSForwarder(); err != nil {
+			fmt.Println("[-] Failed to start DNS forwarder", err)
+		}
+	}
 
-	pluginServer := http.Server{Handler: logRequest(unix_plugin_router)}
+	pluginServer := http.Server{Handler: logRequest(auditRequests(unix_plugin_router))}
 
 	pluginServer.Serve(unixPluginListener)
 }
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+
+	"gopkg.in/validator.v2"
 )
 
 func isValidIPv4(v interface{}, param string) error {
@@ -29,3 +40,272 @@ func isValidDuration(v interface{}, param string) error {
 	_, err := time.ParseDuration(st.String())
 	return err
 }
+
+// the policies SPR understands on a custom interface rule
+var SPRPolicies = []string{"wan", "dns", "lan", "lan_upstream", "api", "quarantine", "disabled", "dns:family"}
+
+var tailnetPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+}
+
+// an address tailscale hands out: CGNAT for IPv4, the tailscale ULA for IPv6.
+// empty is allowed, the IP of a peer is derived from the netmap
+func isValidTailnetIP(v interface{}, param string) error {
+	st := reflect.ValueOf(v)
+	if st.Kind() != reflect.String {
+		return errors.New("must be a string")
+	}
+	if st.String() == "" {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(st.String())
+	if err != nil {
+		return errors.New(st.String() + " is not a valid IP address")
+	}
+	for _, prefix := range tailnetPrefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return nil
+		}
+	}
+	return errors.New(st.String() + " is not a tailnet address (100.64.0.0/10 or fd7a:115c:a1e0::/48)")
+}
+
+func stringList(v interface{}) ([]string, error) {
+	list, ok := v.([]string)
+	if !ok {
+		return nil, errors.New("must be a list of strings")
+	}
+	return list, nil
+}
+
+// known SPR policy names. with param "none" the quarantine marker is allowed too
+func isValidPolicies(v interface{}, param string) error {
+	list, err := stringList(v)
+	if err != nil {
+		return err
+	}
+	for _, policy := range list {
+		if param == AccessNone && policy == AccessNone {
+			continue
+		}
+		if !slices.Contains(SPRPolicies, policy) {
+			return errors.New("unknown policy " + strconv.Quote(policy) + ", expected one of " + strings.Join(SPRPolicies, ", "))
+		}
+	}
+	return nil
+}
+
+// group names must be non-empty and free of whitespace
+func isValidGroups(v interface{}, param string) error {
+	list, err := stringList(v)
+	if err != nil {
+		return err
+	}
+	for _, group := range list {
+		if group == "" {
+			return errors.New("group names must not be empty")
+		}
+		if strings.IndexFunc(group, unicode.IsSpace) >= 0 {
+			return errors.New("group name " + strconv.Quote(group) + " contains whitespace")
+		}
+	}
+	return nil
+}
+
+func isValidRouteMode(v interface{}, param string) error {
+	st := reflect.ValueOf(v)
+	if st.Kind() != reflect.String {
+		return errors.New("must be a string")
+	}
+	if st.String() != "" && !slices.Contains(RouteModes, st.String()) {
+		return errors.New("unknown route mode " + strconv.Quote(st.String()) + ", expected one of " + strings.Join(RouteModes, ", "))
+	}
+	return nil
+}
+
+func isValidCIDRs(v interface{}, param string) error {
+	list, err := stringList(v)
+	if err != nil {
+		return err
+	}
+	for _, cidr := range list {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return errors.New(strconv.Quote(cidr) + " is not a valid CIDR")
+		}
+		if prefix.Bits() == 0 {
+			return errors.New(cidr + " would make this an exit node, use AdvertiseExitNode")
+		}
+		if prefix.Masked() != prefix {
+			return errors.New(cidr + " has host bits set, use " + prefix.Masked().String())
+		}
+	}
+	return nil
+}
+
+func registerValidators() error {
+	funcs := map[string]validator.ValidationFunc{
+		"ipv4":      isValidIPv4,
+		"duration":  isValidDuration,
+		"tailnetip": isValidTailnetIP,
+		"policies":  isValidPolicies,
+		"groups":    isValidGroups,
+		"routemode": isValidRouteMode,
+		"cidrs":     isValidCIDRs,
+	}
+	for name, fn := range funcs {
+		if err := validator.SetValidationFunc(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConfig checks the struct tags and that every referenced profile exists
+func validateConfig(cfg *Config) error {
+	errMap := validator.ErrorMap{}
+	if err := validator.Validate(cfg); err != nil {
+		if fieldErrs, ok := err.(validator.ErrorMap); ok {
+			errMap = fieldErrs
+		} else {
+			return err
+		}
+	}
+
+	checkProfiles := func(field string, names []string) {
+		for _, name := range names {
+			if _, ok := cfg.Profiles[name]; !ok {
+				errMap[field] = append(errMap[field], errors.New("unknown profile "+strconv.Quote(name)))
+			}
+		}
+	}
+	for idx, peer := range cfg.Peers {
+		checkProfiles(fmt.Sprintf("Peers[%d].Profiles", idx), peer.Profiles)
+	}
+	for idx, rule := range cfg.TagRules {
+		checkProfiles(fmt.Sprintf("TagRules[%d].Profiles", idx), rule.Profiles)
+	}
+	for idx, rule := range cfg.UserRules {
+		checkProfiles(fmt.Sprintf("UserRules[%d].Profiles", idx), rule.Profiles)
+	}
+	for idx, rule := range cfg.HostRules {
+		checkProfiles(fmt.Sprintf("HostRules[%d].Profiles", idx), rule.Profiles)
+	}
+
+	for group, routes := range cfg.GroupRoutes {
+		field := "GroupRoutes[" + group + "](value).CIDRs"
+		if routes.Mode == RouteModeCIDRs && len(routes.CIDRs) == 0 {
+			errMap[field] = append(errMap[field], errors.New("mode cidrs needs at least one CIDR"))
+		} else if routes.Mode != RouteModeCIDRs && len(routes.CIDRs) > 0 {
+			errMap[field] = append(errMap[field], errors.New("CIDRs are only used with mode cidrs"))
+		}
+	}
+
+	for group, prefixes := range cfg.RouteImports {
+		field := "RouteImports[" + group + "]"
+		if err := isValidGroups([]string{group}, ""); err != nil {
+			errMap[field] = append(errMap[field], err)
+		}
+		if len(prefixes) == 0 {
+			errMap[field] = append(errMap[field], errors.New("needs at least one prefix"))
+		} else if err := isValidCIDRs(prefixes, ""); err != nil {
+			errMap[field] = append(errMap[field], err)
+		}
+	}
+
+	if cfg.ExitNode.StableID != "" && cfg.AdvertiseExitNode {
+		//both sides are at fault, whichever one is being changed
+		errMap["ExitNode.StableID"] = append(errMap["ExitNode.StableID"], errors.New("cannot use an exit node while advertising as one"))
+		errMap["AdvertiseExitNode"] = append(errMap["AdvertiseExitNode"], errors.New("cannot advertise as an exit node while using one"))
+	}
+
+	if len(errMap) > 0 {
+		return errMap
+	}
+	return nil
+}
+
+// configSection returns the top level Config field of an ErrorMap key, e.g.
+// "GroupRoutes" for "GroupRoutes[lab](value).CIDRs"
+func configSection(key string) string {
+	if idx := strings.IndexAny(key, "[.("); idx >= 0 {
+		return key[:idx]
+	}
+	return key
+}
+
+// validateConfigSections validates cfg like validateConfig, but only reports
+// errors in the given top level fields. a handler changing one section is not
+// blocked by invalid entries elsewhere, e.g. ones saved by an older version
+func validateConfigSections(cfg *Config, sections ...string) error {
+	err := validateConfig(cfg)
+	errMap, ok := err.(validator.ErrorMap)
+	if !ok {
+		return err
+	}
+	changed := validator.ErrorMap{}
+	for key, errs := range errMap {
+		if slices.Contains(sections, configSection(key)) {
+			changed[key] = errs
+		}
+	}
+	if len(changed) > 0 {
+		return changed
+	}
+	return nil
+}
+
+// validatePeer checks a single Peers entry against cfg's profiles. field
+// names are relative to the peer, e.g. "IP"
+func validatePeer(cfg *Config, peer *TailscalePeer) error {
+	errMap := validator.ErrorMap{}
+	if err := validator.Validate(peer); err != nil {
+		if fieldErrs, ok := err.(validator.ErrorMap); ok {
+			errMap = fieldErrs
+		} else {
+			return err
+		}
+	}
+	for _, name := range peer.Profiles {
+		if _, ok := cfg.Profiles[name]; !ok {
+			errMap["Profiles"] = append(errMap["Profiles"], errors.New("unknown profile "+strconv.Quote(name)))
+		}
+	}
+	if len(errMap) > 0 {
+		return errMap
+	}
+	return nil
+}
+
+// validation failures keyed by field, e.g. "Peers[0].IP"
+type ValidationErrors struct {
+	Message string
+	Errors  map[string][]string
+}
+
+func validationErrors(err error) ValidationErrors {
+	result := ValidationErrors{Message: "validation failed", Errors: map[string][]string{}}
+
+	errMap, ok := err.(validator.ErrorMap)
+	if !ok {
+		result.Errors[""] = []string{err.Error()}
+		return result
+	}
+
+	for field, errs := range errMap {
+		for _, fieldErr := range errs {
+			result.Errors[field] = append(result.Errors[field], fieldErr.Error())
+		}
+		sort.Strings(result.Errors[field])
+	}
+	return result
+}
+
+// httpValidationError answers 400 with the per-field errors as JSON
+func httpValidationError(err error, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(validationErrors(err))
+}
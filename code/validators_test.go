@@ -0,0 +1,182 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"testing"
+
+	"gopkg.in/validator.v2"
+)
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name  string
+		fn    validator.ValidationFunc
+		value interface{}
+		param string
+		ok    bool
+	}{
+		{name: "tailnet IPv4", fn: isValidTailnetIP, value: "100.64.0.1", ok: true},
+		{name: "tailnet IPv6", fn: isValidTailnetIP, value: "fd7a:115c:a1e0::1", ok: true},
+		{name: "empty tailnet IP is derived", fn: isValidTailnetIP, value: "", ok: true},
+		{name: "LAN address is not a tailnet IP", fn: isValidTailnetIP, value: "192.168.2.10"},
+		{name: "other ULA is not a tailnet IP", fn: isValidTailnetIP, value: "fd00::1"},
+		{name: "garbage tailnet IP", fn: isValidTailnetIP, value: "100.64.0"},
+		{name: "tailnet IP must be a string", fn: isValidTailnetIP, value: 1},
+
+		{name: "known policies", fn: isValidPolicies, value: []string{"wan", "dns:family"}, ok: true},
+		{name: "no policies", fn: isValidPolicies, value: []string{}, ok: true},
+		{name: "unknown policy", fn: isValidPolicies, value: []string{"wan", "internet"}},
+		{name: "none needs the param", fn: isValidPolicies, value: []string{AccessNone}},
+		{name: "none with the param", fn: isValidPolicies, value: []string{AccessNone}, param: AccessNone, ok: true},
+		{name: "policies must be a list", fn: isValidPolicies, value: "wan"},
+
+		{name: "groups", fn: isValidGroups, value: []string{"lab", "tailnet"}, ok: true},
+		{name: "empty group name", fn: isValidGroups, value: []string{""}},
+		{name: "group name with a space", fn: isValidGroups, value: []string{"my lab"}},
+		{name: "group name with a tab", fn: isValidGroups, value: []string{"lab\t"}},
+
+		{name: "route mode", fn: isValidRouteMode, value: RouteModeSupernet, ok: true},
+		{name: "empty route mode is the default", fn: isValidRouteMode, value: "", ok: true},
+		{name: "unknown route mode", fn: isValidRouteMode, value: "subnet"},
+
+		{name: "CIDRs", fn: isValidCIDRs, value: []string{"192.168.2.0/24", "fd00::/64", "10.0.0.1/32"}, ok: true},
+		{name: "CIDR without a length", fn: isValidCIDRs, value: []string{"192.168.2.0"}},
+		{name: "default route belongs to the exit node", fn: isValidCIDRs, value: []string{"0.0.0.0/0"}},
+		{name: "IPv6 default route", fn: isValidCIDRs, value: []string{"::/0"}},
+		{name: "CIDR with host bits set", fn: isValidCIDRs, value: []string{"192.168.2.1/24"}},
+
+		{name: "duration", fn: isValidDuration, value: "1m30s", ok: true},
+		{name: "duration without a unit", fn: isValidDuration, value: "90"},
+		{name: "IPv4", fn: isValidIPv4, value: "192.168.2.1", ok: true},
+		{name: "bad IPv4", fn: isValidIPv4, value: "192.168.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fn(tt.value, tt.param)
+			if tt.ok && err != nil {
+				t.Errorf("%v: unexpected error %v", tt.value, err)
+			} else if !tt.ok && err == nil {
+				t.Errorf("%v: want an error", tt.value)
+			}
+		})
+	}
+}
+
+func TestConfigSection(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"DefaultGroups", "DefaultGroups"},
+		{"Peers[0].IP", "Peers"},
+		{"GroupRoutes[lab](value).CIDRs", "GroupRoutes"},
+		{"ExitNode.StableID", "ExitNode"},
+		{"RouteImports[remote]", "RouteImports"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := configSection(tt.key); got != tt.want {
+			t.Errorf("configSection(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+// a config that an older version could have saved, invalid in several sections
+func testInvalidConfig() Config {
+	return Config{
+		Peers:         []TailscalePeer{{StableID: "nlaptop", IP: "192.168.2.10", Groups: []string{"lab"}, Policies: []string{}}},
+		DefaultGroups: []string{"my lab"},
+		TagRules:      []TagRule{{Tag: "servers", Groups: []string{"servers"}}},
+		Profiles:      map[string]AccessProfile{"printing": {Groups: []string{"printers"}, Policies: []string{"print"}}},
+		GroupRoutes:   map[string]GroupRoutes{"lab": {Mode: RouteModeCIDRs}},
+		RouteImports:  map[string][]string{"remote": {}},
+		ExitNode:      ExitNodeConfig{StableID: "nexit"},
+	}
+}
+
+func TestValidateConfigSections(t *testing.T) {
+	if err := registerValidators(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		sections []string
+		want     []string // the sections with errors
+	}{
+		{
+			name:     "valid config",
+			cfg:      Config{Peers: []TailscalePeer{{StableID: "nlaptop", IP: "100.64.0.1", Groups: []string{"lab"}}}},
+			sections: []string{"Peers", "DefaultGroups"},
+			want:     []string{},
+		},
+		{
+			name:     "only the requested section is reported",
+			cfg:      testInvalidConfig(),
+			sections: []string{"Peers"},
+			want:     []string{"Peers"},
+		},
+		{
+			name:     "several sections",
+			cfg:      testInvalidConfig(),
+			sections: []string{"DefaultGroups", "TagRules", "Profiles"},
+			want:     []string{"DefaultGroups", "Profiles", "TagRules"},
+		},
+		{
+			name:     "map sections",
+			cfg:      testInvalidConfig(),
+			sections: []string{"GroupRoutes", "RouteImports"},
+			want:     []string{"GroupRoutes", "RouteImports"},
+		},
+		{
+			name:     "errors elsewhere do not block a valid section",
+			cfg:      testInvalidConfig(),
+			sections: []string{"UserRules", "HostRules"},
+			want:     []string{},
+		},
+		{
+			name: "unknown profile references belong to the referencing section",
+			cfg: Config{
+				Peers:    []TailscalePeer{{StableID: "nlaptop", Groups: []string{}, Policies: []string{}, Profiles: []string{"missing"}}},
+				TagRules: []TagRule{{Tag: "tag:servers", Profiles: []string{"missing"}}},
+			},
+			sections: []string{"TagRules"},
+			want:     []string{"TagRules"},
+		},
+		{
+			name: "exit node conflict is reported for either side",
+			cfg: Config{
+				AdvertiseExitNode: true,
+				ExitNode:          ExitNodeConfig{StableID: "nexit"},
+			},
+			sections: []string{"AdvertiseExitNode"},
+			want:     []string{"AdvertiseExitNode"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfigSections(&tt.cfg, tt.sections...)
+			got := []string{}
+			if err != nil {
+				errMap, ok := err.(validator.ErrorMap)
+				if !ok {
+					t.Fatalf("validateConfigSections() = %v, want an ErrorMap", err)
+				}
+				for key := range errMap {
+					if section := configSection(key); !slices.Contains(got, section) {
+						got = append(got, section)
+					}
+				}
+				sort.Strings(got)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sections with errors = %q, want %q (%v)", got, tt.want, err)
+			}
+		})
+	}
+}
@@ -13,6 +13,10 @@ if [ -n "$TAILSCALE_EXIT_NODE" ]; then
   TAILSCALE_ARGS="$TAILSCALE_ARGS --advertise-exit-node"
 fi
 
+if [ -n "$TAILSCALE_USE_EXIT_NODE" ]; then
+  TAILSCALE_ARGS="$TAILSCALE_ARGS --exit-node $TAILSCALE_USE_EXIT_NODE --exit-node-allow-lan-access"
+fi
+
 # Make a best effort attempt to reconnect if we've been pre-authorized.
 # The user may still need to login and/or authorize via the web UI to finish connecting.
 tailscale up $TAILSCALE_ARGS "$@"